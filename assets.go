@@ -0,0 +1,86 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Templates and static files ship inside the binary so pages work in air-gapped clusters
+//
+//go:embed templates/*.html static
+var assets embed.FS
+
+// Applied to every HTML page. form-action is deliberately left out: browsers enforce it on the redirect chain,
+// which would block the gateway from sending users on to their identity provider when logging out.
+const contentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; " +
+	"frame-src 'self'; connect-src 'self'; base-uri 'none'; frame-ancestors 'none'"
+
+// Parses the templates in dir, or the embedded templates when dir is empty. Every template is named after its
+// file.
+func loadTemplates(dir string) (*template.Template, error) {
+	var fsys fs.FS = os.DirFS(dir)
+	if dir == "" {
+		var err error
+		if fsys, err = fs.Sub(assets, "templates"); err != nil {
+			return nil, err
+		}
+	}
+	return template.ParseFS(fsys, "*.html")
+}
+
+// Serves the embedded static files with strong ETags so browsers can cache them and revalidate cheaply
+func staticHandler() (http.Handler, error) {
+	static, err := fs.Sub(assets, "static")
+	if err != nil {
+		return nil, err
+	}
+
+	etags := make(map[string]string)
+	err = fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(static, name)
+		if err != nil {
+			return err
+		}
+		etags["/"+name] = fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := http.FileServer(http.FS(static))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		if etag, ok := etags[r.URL.Path]; ok {
+			w.Header().Set("ETag", etag)
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	}), nil
+}
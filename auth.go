@@ -0,0 +1,161 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errBadCredentials = errors.New("invalid credentials")
+
+type identityKey struct{}
+
+// The caller resolved from an API key or HTTP Basic credentials. Roles and Permissions are filled in from the
+// RBAC policy once the caller has been authenticated.
+type Identity struct {
+	Name        string   `json:"name"`
+	Method      string   `json:"method"`
+	Scopes      []string `json:"scopes"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+type APIKeyCredential struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// Passwords are never stored in clear text, only as bcrypt hashes
+type BasicCredential struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"passwordHash"`
+	Scopes       []string `json:"scopes"`
+}
+
+type Credentials struct {
+	APIKeys []APIKeyCredential `json:"apiKeys"`
+	Users   []BasicCredential  `json:"users"`
+}
+
+type Authenticator struct {
+	apiKeyHeader string
+	apiKeyParam  string
+	apiKeys      []APIKeyCredential
+	users        map[string]BasicCredential
+}
+
+// Reads credentials from the file named by AUTH_CREDENTIALS_FILE or, failing that, the JSON in AUTH_CREDENTIALS
+func loadCredentials() (*Credentials, error) {
+	var data []byte
+	if file := os.Getenv(EnvAuthCredentialsFile); file != "" {
+		var err error
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+	} else if inline := os.Getenv(EnvAuthCredentials); inline != "" {
+		data = []byte(inline)
+	} else {
+		return &Credentials{}, nil
+	}
+
+	creds := &Credentials{}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, fmt.Errorf("parsing credentials: %v", err)
+	}
+	return creds, nil
+}
+
+func newAuthenticator(creds *Credentials, apiKeyHeader, apiKeyParam string) (*Authenticator, error) {
+	a := &Authenticator{
+		apiKeyHeader: apiKeyHeader,
+		apiKeyParam:  apiKeyParam,
+		users:        make(map[string]BasicCredential),
+	}
+
+	for _, k := range creds.APIKeys {
+		if k.Name == "" || k.Key == "" {
+			return nil, errors.New("api keys require both a name and a key")
+		}
+		a.apiKeys = append(a.apiKeys, k)
+	}
+
+	for _, u := range creds.Users {
+		if u.Username == "" {
+			return nil, errors.New("users require a username")
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("user %q: password hash is not a bcrypt hash", u.Username)
+		}
+		a.users[u.Username] = u
+	}
+
+	return a, nil
+}
+
+// Authentication is only enforced once at least one credential has been configured
+func (a *Authenticator) Enabled() bool {
+	return a != nil && (len(a.apiKeys) > 0 || len(a.users) > 0)
+}
+
+// Returns a nil Identity and no error when the request carries no credentials at all
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	key := r.Header.Get(a.apiKeyHeader)
+	if key == "" && a.apiKeyParam != "" {
+		key = r.URL.Query().Get(a.apiKeyParam)
+	}
+	if key == "" {
+		for _, proto := range websocket.Subprotocols(r) {
+			if strings.HasPrefix(proto, wsAPIKeyProtoPrefix) {
+				key = strings.TrimPrefix(proto, wsAPIKeyProtoPrefix)
+				break
+			}
+		}
+	}
+	if key != "" {
+		for _, k := range a.apiKeys {
+			if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+				return &Identity{Name: k.Name, Method: "apikey", Scopes: k.Scopes}, nil
+			}
+		}
+		return nil, errBadCredentials
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		u, found := a.users[username]
+		if !found || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+			return nil, errBadCredentials
+		}
+		return &Identity{Name: u.Username, Method: "basic", Scopes: u.Scopes}, nil
+	}
+
+	return nil, nil
+}
+
+func identityFromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := newAuthenticator(&Credentials{
+		APIKeys: []APIKeyCredential{{Name: "workshop", Key: "s3cret", Scopes: []string{PermFilesWrite}}},
+		Users:   []BasicCredential{{Username: "viewer", PasswordHash: string(hash)}},
+	}, "X-API-Key", "api_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func TestServer_Authorize(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	s := Server{auth: auth, policy: defaultPolicy(false)}
+	handler := s.authorize(PermFilesWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "workshop", identityFromContext(r.Context()).Name)
+	}))
+
+	cases := []struct {
+		name   string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"anonymous", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"header key", func(r *http.Request) { r.Header.Set("X-API-Key", "s3cret") }, http.StatusOK},
+		{"wrong key", func(r *http.Request) { r.Header.Set("X-API-Key", "nope") }, http.StatusUnauthorized},
+		{"query key", func(r *http.Request) { r.URL.RawQuery = "api_key=s3cret" }, http.StatusOK},
+		{"subprotocol key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "quote.v1, apikey.s3cret") }, http.StatusOK},
+		{"basic viewer", func(r *http.Request) { r.SetBasicAuth("viewer", "hunter2") }, http.StatusForbidden},
+		{"basic wrong password", func(r *http.Request) { r.SetBasicAuth("viewer", "hunter3") }, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/files/upload", nil)
+		c.setup(req)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(t, c.status, rr.Code, c.name)
+	}
+}
+
+func TestServer_AuthorizeWithoutCredentials(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	cases := []struct {
+		name   string
+		policy *Policy
+		perm   string
+		status int
+	}{
+		{"read", nil, PermQuotesRead, http.StatusOK},
+		{"upload", nil, PermFilesWrite, http.StatusUnauthorized},
+		{"admin", nil, PermAdminConfig, http.StatusUnauthorized},
+		{"upload with AUTH_DISABLED", defaultPolicy(true), PermFilesWrite, http.StatusOK},
+		{"admin with AUTH_DISABLED", defaultPolicy(true), PermAdminConfig, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		s := Server{policy: c.policy}
+		rr := httptest.NewRecorder()
+		s.authorize(c.perm)(ok).ServeHTTP(rr, httptest.NewRequest("POST", "/files/upload", nil))
+		assert.Equal(t, c.status, rr.Code, c.name)
+	}
+}
+
+func TestServer_WhoAmI(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	policy := defaultPolicy(false)
+	policy.Bindings["viewer"] = []string{"editor"}
+	s := Server{auth: auth, policy: policy}
+
+	req := httptest.NewRequest("GET", "/whoami", nil)
+	req.SetBasicAuth("viewer", "hunter2")
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.WhoAmI).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	id := Identity{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &id))
+	assert.Equal(t, []string{"editor"}, id.Roles)
+	assert.True(t, id.Can(PermFilesDelete))
+	assert.False(t, id.Can(PermAdminConfig))
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.WhoAmI).ServeHTTP(rr, httptest.NewRequest("GET", "/whoami", nil))
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &id))
+	assert.Equal(t, anonymousName, id.Name)
+	assert.Equal(t, []string{PermFilesRead, PermQuotesRead}, id.Permissions)
+}
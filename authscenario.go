@@ -0,0 +1,293 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	ScenarioAllow     = "allow"
+	ScenarioDeny      = "deny"
+	ScenarioAlternate = "alternate"
+	ScenarioNth       = "nth"
+	ScenarioPercent   = "percent"
+	ScenarioHeader    = "header"
+	ScenarioRedirect  = "redirect"
+
+	StateKeyPath   = "path"
+	StateKeyClient = "client"
+
+	// Header used by callers to pick a scenario for a single request
+	AuthScenarioHeader = "X-Auth-Scenario"
+
+	// Request counts kept for the counting scenarios. The least recently used path or client is forgotten first, so
+	// requests to random paths cannot grow the map without bound.
+	maxAuthCounts = 10000
+)
+
+// Describes how /auth/* answers. Mode picks the decision; the remaining fields tune it.
+type AuthScenario struct {
+	Mode         string            `json:"mode"`
+	N            int               `json:"n,omitempty"`
+	Percent      float64           `json:"percent,omitempty"`
+	Header       string            `json:"header,omitempty"`
+	HeaderValue  string            `json:"headerValue,omitempty"`
+	LoginURL     string            `json:"loginURL,omitempty"`
+	AllowStatus  int               `json:"allowStatus,omitempty"`
+	DenyStatus   int               `json:"denyStatus,omitempty"`
+	AllowHeaders map[string]string `json:"allowHeaders,omitempty"`
+	DenyHeaders  map[string]string `json:"denyHeaders,omitempty"`
+	StateKey     string            `json:"stateKey,omitempty"`
+}
+
+type AuthScenarioConfig struct {
+	Default   string                   `json:"default"`
+	Scenarios map[string]*AuthScenario `json:"scenarios"`
+}
+
+// Decides /auth/* responses and tracks request counts per scenario and path or client
+type AuthTester struct {
+	config *AuthScenarioConfig
+
+	mu     sync.Mutex
+	counts map[string]*list.Element
+	recent *list.List
+}
+
+type authCount struct {
+	key string
+	n   int
+}
+
+// Scenarios that are always available unless the config file overrides them by name. "alternate" keeps the
+// original behavior of failing with a 500 and then succeeding.
+func defaultAuthScenarios() map[string]*AuthScenario {
+	return map[string]*AuthScenario{
+		ScenarioAllow:     {Mode: ScenarioAllow},
+		ScenarioDeny:      {Mode: ScenarioDeny},
+		ScenarioAlternate: {Mode: ScenarioAlternate, DenyStatus: http.StatusInternalServerError},
+		ScenarioNth:       {Mode: ScenarioNth, N: 3},
+		ScenarioPercent:   {Mode: ScenarioPercent, Percent: 50},
+		ScenarioHeader:    {Mode: ScenarioHeader, Header: "X-Deny"},
+		ScenarioRedirect:  {Mode: ScenarioRedirect, LoginURL: "/login"},
+	}
+}
+
+// Reads scenarios from AUTH_SCENARIOS_FILE and merges them over the built-in ones. AUTH_SCENARIO selects the
+// default scenario.
+func loadAuthScenarios() (*AuthScenarioConfig, error) {
+	config := &AuthScenarioConfig{}
+	if file := os.Getenv(EnvAuthScenariosFile); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("parsing auth scenarios: %v", err)
+		}
+	}
+
+	scenarios := defaultAuthScenarios()
+	for name, scenario := range config.Scenarios {
+		scenarios[name] = scenario
+	}
+	config.Scenarios = scenarios
+
+	if def := os.Getenv(EnvAuthScenario); def != "" {
+		config.Default = def
+	}
+	if config.Default == "" {
+		config.Default = ScenarioAlternate
+	}
+
+	for name, scenario := range config.Scenarios {
+		if err := scenario.validate(); err != nil {
+			return nil, fmt.Errorf("auth scenario %q: %v", name, err)
+		}
+	}
+	if _, ok := config.Scenarios[config.Default]; !ok {
+		return nil, fmt.Errorf("default auth scenario %q is not defined", config.Default)
+	}
+	return config, nil
+}
+
+func (a *AuthScenario) validate() error {
+	if a == nil {
+		return fmt.Errorf("scenario must be an object, not null")
+	}
+
+	switch a.Mode {
+	case ScenarioAllow, ScenarioDeny, ScenarioAlternate:
+	case ScenarioNth:
+		if a.N < 1 {
+			return fmt.Errorf("n must be at least 1")
+		}
+	case ScenarioPercent:
+		if a.Percent < 0 || a.Percent > 100 {
+			return fmt.Errorf("percent must be in range 0..100 (inclusive)")
+		}
+	case ScenarioHeader:
+		if a.Header == "" {
+			return fmt.Errorf("header is required")
+		}
+	case ScenarioRedirect:
+		if a.LoginURL == "" {
+			return fmt.Errorf("loginURL is required")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", a.Mode)
+	}
+
+	switch a.StateKey {
+	case "", StateKeyPath, StateKeyClient:
+	default:
+		return fmt.Errorf("unknown stateKey %q", a.StateKey)
+	}
+
+	// Zero picks the mode's default status. Anything else outside of the HTTP range panics in WriteHeader.
+	if !validStatus(a.AllowStatus) {
+		return fmt.Errorf("allowStatus must be in range 100..599 (inclusive)")
+	}
+	if !validStatus(a.DenyStatus) {
+		return fmt.Errorf("denyStatus must be in range 100..599 (inclusive)")
+	}
+	return nil
+}
+
+func validStatus(status int) bool {
+	return status == 0 || (status >= 100 && status <= 599)
+}
+
+func newAuthTester(config *AuthScenarioConfig) *AuthTester {
+	return &AuthTester{config: config, counts: make(map[string]*list.Element), recent: list.New()}
+}
+
+// Increments and returns the request count for the scenario's state key
+func (t *AuthTester) count(name string, scenario *AuthScenario, r *http.Request) int {
+	key := name + "|" + r.URL.Path
+	if scenario.StateKey == StateKeyClient {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		key = name + "|" + host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.counts[key]; ok {
+		t.recent.MoveToFront(e)
+		e.Value.(*authCount).n++
+		return e.Value.(*authCount).n
+	}
+	t.counts[key] = t.recent.PushFront(&authCount{key: key, n: 1})
+	if t.recent.Len() > maxAuthCounts {
+		oldest := t.recent.Remove(t.recent.Back()).(*authCount)
+		delete(t.counts, oldest.key)
+	}
+	return 1
+}
+
+func (t *AuthTester) allowed(name string, scenario *AuthScenario, r *http.Request) bool {
+	switch scenario.Mode {
+	case ScenarioAllow:
+		return true
+	case ScenarioAlternate:
+		return t.count(name, scenario, r)%2 == 0
+	case ScenarioNth:
+		return t.count(name, scenario, r)%scenario.N == 0
+	case ScenarioPercent:
+		return rand.Float64()*100 >= scenario.Percent
+	case ScenarioHeader:
+		values, ok := r.Header[http.CanonicalHeaderKey(scenario.Header)]
+		if !ok {
+			return true
+		}
+		if scenario.HeaderValue == "" {
+			return false
+		}
+		for _, v := range values {
+			if v == scenario.HeaderValue {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// Appends the original request URI to the login URL so the login page can send the caller back
+func loginRedirect(loginURL, requestURI string) string {
+	sep := "?"
+	if strings.Contains(loginURL, "?") {
+		sep = "&"
+	}
+	return loginURL + sep + "rd=" + url.QueryEscape(requestURI)
+}
+
+func (s *Server) TestAuth(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(AuthScenarioHeader)
+	if name == "" {
+		name = s.authTester.config.Default
+	}
+
+	scenario, ok := s.authTester.config.Scenarios[name]
+	if !ok {
+		log.Printf("ERROR: Unknown auth scenario %q\n", name)
+		http.Error(w, "Unknown auth scenario", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set(AuthScenarioHeader, name)
+
+	if s.authTester.allowed(name, scenario, r) {
+		for k, v := range scenario.AllowHeaders {
+			w.Header().Set(k, v)
+		}
+		status := scenario.AllowStatus
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		return
+	}
+
+	for k, v := range scenario.DenyHeaders {
+		w.Header().Set(k, v)
+	}
+	status := scenario.DenyStatus
+	if scenario.Mode == ScenarioRedirect {
+		if status == 0 {
+			status = http.StatusFound
+		}
+		w.Header().Set("Location", loginRedirect(scenario.LoginURL, r.URL.RequestURI()))
+	}
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	w.WriteHeader(status)
+}
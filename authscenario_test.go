@@ -0,0 +1,123 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer_TestAuth(t *testing.T) {
+	s := Server{authTester: newAuthTester(&AuthScenarioConfig{
+		Default:   ScenarioAlternate,
+		Scenarios: defaultAuthScenarios(),
+	})}
+
+	status := func(path, scenario string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if scenario != "" {
+			req.Header.Set(AuthScenarioHeader, scenario)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.TestAuth).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// alternate is tracked per path
+	assert.Equal(t, http.StatusInternalServerError, status("/auth/a", "", nil).Code)
+	assert.Equal(t, http.StatusInternalServerError, status("/auth/b", "", nil).Code)
+	assert.Equal(t, http.StatusOK, status("/auth/a", "", nil).Code)
+
+	assert.Equal(t, http.StatusOK, status("/auth/", ScenarioAllow, nil).Code)
+	assert.Equal(t, http.StatusForbidden, status("/auth/", ScenarioDeny, nil).Code)
+
+	assert.Equal(t, http.StatusForbidden, status("/auth/n", ScenarioNth, nil).Code)
+	assert.Equal(t, http.StatusForbidden, status("/auth/n", ScenarioNth, nil).Code)
+	assert.Equal(t, http.StatusOK, status("/auth/n", ScenarioNth, nil).Code)
+
+	assert.Equal(t, http.StatusOK, status("/auth/", ScenarioHeader, nil).Code)
+	assert.Equal(t, http.StatusForbidden, status("/auth/", ScenarioHeader, http.Header{"X-Deny": {"1"}}).Code)
+
+	rr := status("/auth/page?x=1", ScenarioRedirect, nil)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "/login?rd=%2Fauth%2Fpage%3Fx%3D1", rr.Header().Get("Location"))
+
+	assert.Equal(t, http.StatusBadRequest, status("/auth/", "nope", nil).Code)
+}
+
+func TestAuthTester_Forgets(t *testing.T) {
+	tester := newAuthTester(&AuthScenarioConfig{Default: ScenarioAlternate, Scenarios: defaultAuthScenarios()})
+	scenario := tester.config.Scenarios[ScenarioAlternate]
+
+	assert.Equal(t, 1, tester.count(ScenarioAlternate, scenario, httptest.NewRequest("GET", "/auth/first", nil)))
+	for i := 0; i < maxAuthCounts; i++ {
+		tester.count(ScenarioAlternate, scenario, httptest.NewRequest("GET", fmt.Sprintf("/auth/%d", i), nil))
+	}
+	assert.Len(t, tester.counts, maxAuthCounts)
+	assert.Equal(t, maxAuthCounts, tester.recent.Len())
+
+	// The first path was the least recently used, so it starts over
+	assert.Equal(t, 1, tester.count(ScenarioAlternate, scenario, httptest.NewRequest("GET", "/auth/first", nil)))
+	assert.Equal(t, 2, tester.count(ScenarioAlternate, scenario, httptest.NewRequest("GET", fmt.Sprintf("/auth/%d", maxAuthCounts-1), nil)))
+}
+
+func TestAuthScenario_Validate(t *testing.T) {
+	cases := []struct {
+		name     string
+		scenario *AuthScenario
+		valid    bool
+	}{
+		{"default statuses", &AuthScenario{Mode: ScenarioDeny}, true},
+		{"custom statuses", &AuthScenario{Mode: ScenarioAlternate, AllowStatus: 204, DenyStatus: 599}, true},
+		{"nth without n", &AuthScenario{Mode: ScenarioNth}, false},
+		{"unknown mode", &AuthScenario{Mode: "sometimes"}, false},
+		{"allow status too small", &AuthScenario{Mode: ScenarioAllow, AllowStatus: 42}, false},
+		{"deny status too large", &AuthScenario{Mode: ScenarioDeny, DenyStatus: 1000}, false},
+		{"null", nil, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.scenario.validate()
+			if c.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestLoadAuthScenarios_Null(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "scenarios.json")
+	if err := ioutil.WriteFile(file, []byte(`{"scenarios": {"broken": null}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(EnvAuthScenariosFile, file)
+	defer os.Unsetenv(EnvAuthScenariosFile)
+
+	_, err := loadAuthScenarios()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `"broken"`)
+	}
+}
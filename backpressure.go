@@ -0,0 +1,155 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// What the hub does when a client's send buffer is full
+const (
+	// Disconnect the client
+	OverflowDisconnect = "disconnect"
+	// Discard the oldest queued frame to make room
+	OverflowDropOldest = "drop-oldest"
+	// Discard the new frame
+	OverflowDropNewest = "drop-newest"
+	// Discard every queued quote so only the latest one is left
+	OverflowCoalesce = "coalesce"
+)
+
+func checkOverflowPolicy(policy string) error {
+	switch policy {
+	case OverflowDisconnect, OverflowDropOldest, OverflowDropNewest, OverflowCoalesce:
+		return nil
+	}
+	return fmt.Errorf("overflow must be one of %s, %s, %s or %s", OverflowDisconnect, OverflowDropOldest, OverflowDropNewest, OverflowCoalesce)
+}
+
+// How many frames were discarded and clients disconnected under a slow consumer policy
+type OverflowCount struct {
+	Dropped      int `json:"dropped"`
+	Disconnected int `json:"disconnected"`
+}
+
+type HubStats struct {
+	Policy    string                    `json:"policy"`
+	QueueSize int                       `json:"queue_size"`
+	Clients   int                       `json:"clients"`
+	Overflows map[string]*OverflowCount `json:"overflows"`
+}
+
+func (h *Hub) overflowCount(policy string) *OverflowCount {
+	count, ok := h.overflows[policy]
+	if !ok {
+		count = &OverflowCount{}
+		h.overflows[policy] = count
+	}
+	return count
+}
+
+// Applies the client's slow consumer policy to a frame that did not fit in its send buffer. Returns whether the
+// frame was queued in the end.
+func (h *Hub) overflow(client *Client, frame *Frame) bool {
+	count := h.overflowCount(client.overflow)
+	switch client.overflow {
+	case OverflowDropNewest:
+		count.Dropped++
+		client.dropped++
+		return false
+	case OverflowDropOldest:
+		select {
+		case <-client.send:
+			count.Dropped++
+			client.dropped++
+		default:
+		}
+		if queue(client, frame) {
+			return true
+		}
+	case OverflowCoalesce:
+		removed := coalesce(client)
+		count.Dropped += removed
+		client.dropped += removed
+		if queue(client, frame) {
+			return true
+		}
+	}
+
+	count.Disconnected++
+	client.dropped++
+	h.drop(client)
+	return false
+}
+
+// Takes the queued quotes out of the client's send buffer, keeping every other frame in order. Returns how many
+// quotes were taken out.
+func coalesce(client *Client) int {
+	var kept []*Frame
+	removed := 0
+	for n := len(client.send); n > 0; n-- {
+		select {
+		case frame := <-client.send:
+			if frame.Type == FrameQuote {
+				removed++
+			} else {
+				kept = append(kept, frame)
+			}
+		default:
+			// The pump emptied the buffer
+			n = 1
+		}
+	}
+	for _, frame := range kept {
+		queue(client, frame)
+	}
+	return removed
+}
+
+func (h *Hub) stats() HubStats {
+	overflows := make(map[string]*OverflowCount, len(h.overflows))
+	for policy, count := range h.overflows {
+		c := *count
+		overflows[policy] = &c
+	}
+	return HubStats{Policy: h.policy, QueueSize: h.queueSize, Clients: len(h.clients), Overflows: overflows}
+}
+
+// Reports the hub's slow consumer policy and how often clients overflowed their send buffers
+func (s *Server) GetHubStats(w http.ResponseWriter, r *http.Request) {
+	res := make(chan HubStats, 1)
+	select {
+	case s.hub.statsReqs <- res:
+	case <-s.hub.done:
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	resJson, err := json.MarshalIndent(<-res, "", "    ")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(resJson); err != nil {
+		log.Panicln(err)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+const (
+	// Largest request body accepted by the debug handler and uploads unless MAX_BODY_SIZE says otherwise
+	defaultMaxBodySize = 32 << 20
+
+	// How much of a request body the debug handler echoes unless DEBUG_BODY_BUFFER says otherwise. The rest is only
+	// hashed and counted.
+	defaultDebugBodyBuffer = 1 << 20
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// Fails reads with errBodyTooLarge once more than the limit was read. The http.MaxBytesReader underneath also makes
+// the server close the connection rather than read the rest of the body.
+type maxBodyReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	m.remaining -= int64(n)
+	if err != nil && err != io.EOF && m.remaining <= 0 {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// Caps the request body at s.maxBodySize. Responds with 413 and returns false when the declared length is already
+// too large; bodies without a length fail with errBodyTooLarge as they are read. A zero size disables the limit.
+func (s *Server) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	if s.maxBodySize <= 0 {
+		return true
+	}
+	if r.ContentLength > s.maxBodySize {
+		http.Error(w, errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	r.Body = &maxBodyReader{ReadCloser: http.MaxBytesReader(w, r.Body, s.maxBodySize), remaining: s.maxBodySize}
+	return true
+}
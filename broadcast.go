@@ -0,0 +1,124 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A message pushed to stream clients through the hub. With none of Topic, Room or Client set it goes to every client.
+type BroadcastRequest struct {
+	Message string `json:"message"`
+	Topic   string `json:"topic,omitempty"`
+	Room    string `json:"room,omitempty"`
+	Client  string `json:"client,omitempty"`
+}
+
+// How many clients a broadcast was sent to and how many of those were disconnected as slow consumers
+type BroadcastResult struct {
+	Targeted int `json:"targeted"`
+	Dropped  int `json:"dropped"`
+}
+
+type broadcast struct {
+	req    BroadcastRequest
+	result chan BroadcastResult
+}
+
+// Reports whether the client is a target of the broadcast. A topic matches clients whose filter has it as a tag.
+func (b *broadcast) targets(client *Client) bool {
+	switch {
+	case b.req.Client != "":
+		return client.id == b.req.Client
+	case b.req.Room != "":
+		return client.room != nil && client.room.name == b.req.Room
+	case b.req.Topic != "":
+		if !client.subscribed {
+			return false
+		}
+		for _, tag := range client.filter.Tags {
+			if strings.EqualFold(tag, b.req.Topic) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func (h *Hub) fanOut(b *broadcast) BroadcastResult {
+	res := BroadcastResult{}
+	frame := broadcastFrame(b.req.Message)
+	for client := range h.clients {
+		if !b.targets(client) {
+			continue
+		}
+		res.Targeted++
+		if !h.send(client, frame) {
+			res.Dropped++
+		}
+	}
+	return res
+}
+
+// Pushes a message to the stream clients picked by the request
+func (s *Server) Broadcast(w http.ResponseWriter, r *http.Request) {
+	req := BroadcastRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "malformed broadcast: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		http.Error(w, "message is required", http.StatusBadRequest)
+		return
+	}
+	targets := 0
+	for _, target := range []string{req.Topic, req.Room, req.Client} {
+		if target != "" {
+			targets++
+		}
+	}
+	if targets > 1 {
+		http.Error(w, "only one of topic, room and client can be set", http.StatusBadRequest)
+		return
+	}
+
+	b := &broadcast{req: req, result: make(chan BroadcastResult, 1)}
+	select {
+	case s.hub.broadcast <- b:
+	case <-s.hub.done:
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	res := <-b.result
+	log.Printf("broadcast sent to %d clients, %d dropped\n", res.Targeted, res.Dropped)
+
+	resJson, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(resJson); err != nil {
+		log.Panicln(err)
+	}
+}
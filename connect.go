@@ -0,0 +1,230 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	contentTypeConnectStream = "application/connect"
+
+	// Flag of the frame that ends a Connect stream with its error and trailers
+	connectEndStreamFlag = 0x02
+
+	// Largest timeout the gRPC millisecond unit can carry
+	grpcMaxTimeoutMS = 99999999
+)
+
+// Connect error codes and the HTTP status unary calls answer with for them
+var connectCodes = map[codes.Code]struct {
+	name   string
+	status int
+}{
+	codes.Canceled:           {"canceled", 499},
+	codes.Unknown:            {"unknown", http.StatusInternalServerError},
+	codes.InvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	codes.DeadlineExceeded:   {"deadline_exceeded", http.StatusGatewayTimeout},
+	codes.NotFound:           {"not_found", http.StatusNotFound},
+	codes.AlreadyExists:      {"already_exists", http.StatusConflict},
+	codes.PermissionDenied:   {"permission_denied", http.StatusForbidden},
+	codes.ResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	codes.FailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	codes.Aborted:            {"aborted", http.StatusConflict},
+	codes.OutOfRange:         {"out_of_range", http.StatusBadRequest},
+	codes.Unimplemented:      {"unimplemented", http.StatusNotImplemented},
+	codes.Internal:           {"internal", http.StatusInternalServerError},
+	codes.Unavailable:        {"unavailable", http.StatusServiceUnavailable},
+	codes.DataLoss:           {"data_loss", http.StatusInternalServerError},
+	codes.Unauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+type ConnectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// The JSON of the frame that ends a Connect stream
+type ConnectEndStream struct {
+	Error    *ConnectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+func connectError(st *status.Status) *ConnectError {
+	return &ConnectError{Code: connectCodes[st.Code()].name, Message: st.Message()}
+}
+
+func writeConnectError(w http.ResponseWriter, st *status.Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(connectCodes[st.Code()].status)
+	if err := json.NewEncoder(w).Encode(connectError(st)); err != nil {
+		log.Println(err)
+	}
+}
+
+// Looks up the method a Connect call names in its path, e.g. /qotm.v1.QuoteService/GetQuote
+func (s *Server) rpcMethod(path string) (grpc.MethodInfo, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) != 2 {
+		return grpc.MethodInfo{}, false
+	}
+	for _, m := range s.grpc.GetServiceInfo()[parts[0]].Methods {
+		if m.Name == parts[1] {
+			return m, true
+		}
+	}
+	return grpc.MethodInfo{}, false
+}
+
+// Turns the Connect-Timeout-Ms header into a grpc-timeout value. Returns false when the header is malformed.
+func connectTimeout(r *http.Request) (string, bool) {
+	v := r.Header.Get("Connect-Timeout-Ms")
+	if v == "" {
+		return "", true
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || ms < 0 || len(v) > 10 {
+		return "", false
+	}
+	if ms > grpcMaxTimeoutMS {
+		return strconv.FormatInt(ms/1000, 10) + "S", true
+	}
+	return strconv.FormatInt(ms, 10) + "m", true
+}
+
+// Checks what every Connect call must get right before it reaches the gRPC server. Writes the error and returns false
+// when the call cannot go on.
+func (s *Server) checkConnect(w http.ResponseWriter, r *http.Request, streaming bool, encodingHeader string) (string, bool) {
+	method, ok := s.rpcMethod(r.URL.Path)
+	if !ok {
+		writeConnectError(w, status.Newf(codes.Unimplemented, "unknown method %s", r.URL.Path))
+		return "", false
+	}
+	if method.IsClientStream || method.IsServerStream {
+		if !streaming {
+			http.Error(w, r.URL.Path+" is a streaming method, use application/connect+proto or application/connect+json", http.StatusUnsupportedMediaType)
+			return "", false
+		}
+	} else if streaming {
+		http.Error(w, r.URL.Path+" is a unary method, use application/proto or application/json", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	if enc := r.Header.Get(encodingHeader); enc != "" && enc != "identity" {
+		writeConnectError(w, status.Newf(codes.Unimplemented, "%s %s is not supported", encodingHeader, enc))
+		return "", false
+	}
+	timeout, ok := connectTimeout(r)
+	if !ok {
+		writeConnectError(w, status.New(codes.InvalidArgument, "Connect-Timeout-Ms must be a positive number of at most 10 digits"))
+		return "", false
+	}
+	return timeout, true
+}
+
+// Translates a Connect unary call. The body is the bare request message; the response is the bare reply message, with
+// the trailers as Trailer- headers, or a JSON error.
+func (s *Server) serveConnectUnary(w http.ResponseWriter, r *http.Request, codec string) {
+	timeout, ok := s.checkConnect(w, r, false, "Content-Encoding")
+	if !ok || !s.limitBody(w, r) {
+		return
+	}
+	msg, err := ioutil.ReadAll(r.Body)
+	if errors.Is(err, errBodyTooLarge) {
+		writeConnectError(w, status.New(codes.ResourceExhausted, err.Error()))
+		return
+	} else if err != nil {
+		writeConnectError(w, status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	var reply bytes.Buffer
+	var header http.Header
+	rec := newGRPCRecorder(&reply, func(_ int, h http.Header) { header = h })
+	s.callGRPC(rec, r, "application/grpc+"+codec, bytes.NewReader(envelope(0, msg)), timeout)
+
+	st, trailers := rec.trailers()
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	for name, values := range trailers {
+		w.Header()["Trailer-"+name] = values
+	}
+	if st.Code() != codes.OK {
+		writeConnectError(w, st)
+		return
+	}
+
+	frame := reply.Bytes()
+	if len(frame) < 5 || int(binary.BigEndian.Uint32(frame[1:5])) > len(frame)-5 {
+		writeConnectError(w, status.New(codes.Internal, "the call ended without a reply"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+codec)
+	w.WriteHeader(http.StatusOK)
+	w.Write(frame[5 : 5+binary.BigEndian.Uint32(frame[1:5])])
+}
+
+// Translates a Connect streaming call. Connect frames messages the way gRPC does, so they pass through as they are;
+// the status and trailers follow in an end of stream frame.
+func (s *Server) serveConnectStream(w http.ResponseWriter, r *http.Request, mediaType string) {
+	codec, ok := rpcCodec(mediaType, contentTypeConnectStream)
+	if !ok {
+		http.Error(w, "Connect messages must be proto or json", http.StatusUnsupportedMediaType)
+		return
+	}
+	timeout, ok := s.checkConnect(w, r, true, "Connect-Content-Encoding")
+	if !ok {
+		return
+	}
+
+	rec := newGRPCRecorder(w, func(code int, header http.Header) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Type", contentTypeConnectStream+"+"+codec)
+		w.WriteHeader(code)
+	})
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		rec.flush = flusher.Flush
+	}
+	s.callGRPC(rec, r, "application/grpc+"+codec, r.Body, timeout)
+
+	st, trailers := rec.trailers()
+	end := ConnectEndStream{Metadata: trailers}
+	if st.Code() != codes.OK {
+		end.Error = connectError(st)
+	}
+	data, err := json.Marshal(end)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	rec.Write(envelope(connectEndStreamFlag, data))
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
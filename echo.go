@@ -0,0 +1,350 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Largest multipart body the debug handler and uploads decode in memory. Bigger parts spill to disk.
+	formMaxMemory = 32 << 20
+
+	// Limits on how a request can shape the debug response
+	echoMaxSize  = 10 << 20
+	echoMaxDelay = 30 * time.Second
+
+	// Size of the chunks written between two chunk delays
+	echoChunkSize = 1024
+)
+
+// A request body as the debug handler saw it: its start, its size and the hash of all of it
+type debugBody struct {
+	data      []byte
+	size      int64
+	sha256    string
+	truncated bool
+}
+
+// Reads the request body, keeping at most buffer bytes of it in memory. A buffer of zero keeps
+// defaultDebugBodyBuffer bytes.
+func readDebugBody(r *http.Request, buffer int) (debugBody, error) {
+	if buffer <= 0 {
+		buffer = defaultDebugBodyBuffer
+	}
+	hash, buf := sha256.New(), cappedBuffer{limit: buffer}
+	if r.Body != nil {
+		if _, err := io.Copy(io.MultiWriter(hash, &buf), r.Body); err != nil {
+			return debugBody{}, err
+		}
+	}
+	return debugBody{
+		data:      buf.Bytes(),
+		size:      int64(buf.size),
+		sha256:    hex.EncodeToString(hash.Sum(nil)),
+		truncated: buf.truncated,
+	}, nil
+}
+
+// A file uploaded in a multipart body, without its content
+type DebugFile struct {
+	Field       string `json:"field"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// The TLS connection state of a request, as seen by this server
+type DebugTLS struct {
+	Version            string             `json:"version"`
+	CipherSuite        string             `json:"cipher_suite"`
+	ServerName         string             `json:"server_name"`
+	NegotiatedProtocol string             `json:"negotiated_protocol"`
+	PeerCertificates   []DebugCertificate `json:"peer_certificates"`
+}
+
+type DebugCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func debugTLS(state *tls.ConnectionState) *DebugTLS {
+	if state == nil {
+		return nil
+	}
+
+	version, ok := tlsVersions[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	info := &DebugTLS{
+		Version:            version,
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		PeerCertificates:   []DebugCertificate{},
+	}
+	for _, cert := range state.PeerCertificates {
+		info.PeerCertificates = append(info.PeerCertificates, DebugCertificate{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			Serial:    cert.SerialNumber.String(),
+			NotBefore: cert.NotBefore.UTC(),
+			NotAfter:  cert.NotAfter.UTC(),
+			DNSNames:  cert.DNSNames,
+		})
+	}
+	return info
+}
+
+func debugCookies(r *http.Request) map[string]string {
+	cookies := make(map[string]string)
+	for _, c := range r.Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	return cookies
+}
+
+// Decodes a URL encoded or multipart body. The request body must already be buffered; it is restored afterwards so
+// the raw body can still be echoed.
+func debugForm(r *http.Request) (map[string][]string, []DebugFile) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return nil, nil
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	defer func() {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}()
+
+	if mediaType == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			return nil, nil
+		}
+		return r.PostForm, nil
+	}
+
+	if err := r.ParseMultipartForm(formMaxMemory); err != nil {
+		return nil, nil
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	var files []DebugFile
+	for field, headers := range r.MultipartForm.File {
+		for _, h := range headers {
+			files = append(files, DebugFile{Field: field, Filename: h.Filename, ContentType: h.Header.Get("Content-Type"), Size: h.Size})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Field+files[i].Filename < files[j].Field+files[j].Filename })
+	return r.MultipartForm.Value, files
+}
+
+// How a request asks the debug handler to shape its response. A size of -1 means the body is the JSON echo rather
+// than generated bytes.
+type echoShape struct {
+	status      int
+	headers     http.Header
+	size        int
+	fill        string
+	contentType string
+	delay       time.Duration
+	chunkDelay  time.Duration
+	redirect    string
+}
+
+// Returns the values of a shaping control. Controls are given as query parameters or as the matching X-Echo-*
+// header, e.g. `chunk_delay_ms` or `X-Echo-Chunk-Delay-Ms`. The query parameter wins when both are set.
+func echoControl(r *http.Request, name string) []string {
+	if values, ok := r.URL.Query()[name]; ok {
+		return values
+	}
+	return r.Header[textproto.CanonicalMIMEHeaderKey("X-Echo-"+strings.Replace(name, "_", "-", -1))]
+}
+
+func parseEchoShape(r *http.Request) (echoShape, error) {
+	shape := echoShape{status: http.StatusOK, headers: http.Header{}, size: -1, fill: "random"}
+
+	if v := echoControl(r, "status"); len(v) > 0 {
+		n, err := strconv.Atoi(v[0])
+		if err != nil || n < 200 || n > 599 {
+			return shape, errors.New("status must be a number between 200 and 599")
+		}
+		shape.status = n
+	}
+
+	for _, header := range echoControl(r, "header") {
+		parts := strings.SplitN(header, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") {
+			return shape, errors.New("header must be in the form 'Name: value'")
+		}
+		shape.headers.Add(name, strings.TrimSpace(parts[1]))
+	}
+
+	if v := echoControl(r, "size"); len(v) > 0 {
+		n, err := strconv.Atoi(v[0])
+		if err != nil || n < 0 || n > echoMaxSize {
+			return shape, fmt.Errorf("size must be a number of bytes no larger than %d", echoMaxSize)
+		}
+		shape.size = n
+	}
+
+	if v := echoControl(r, "fill"); len(v) > 0 {
+		if v[0] == "" {
+			return shape, errors.New("fill must be 'random' or the bytes to repeat")
+		}
+		shape.fill = v[0]
+	}
+
+	if v := echoControl(r, "content_type"); len(v) > 0 {
+		shape.contentType = v[0]
+	}
+
+	var err error
+	if shape.delay, err = echoDelay(r, "delay_ms"); err != nil {
+		return shape, err
+	}
+	if shape.chunkDelay, err = echoDelay(r, "chunk_delay_ms"); err != nil {
+		return shape, err
+	}
+
+	if v := echoControl(r, "redirect"); len(v) > 0 {
+		if v[0] == "" {
+			return shape, errors.New("redirect must be a location")
+		}
+		shape.redirect = v[0]
+		if len(echoControl(r, "status")) == 0 {
+			shape.status = http.StatusFound
+		}
+	}
+
+	return shape, nil
+}
+
+func echoDelay(r *http.Request, name string) (time.Duration, error) {
+	v := echoControl(r, name)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v[0])
+	if err != nil || n < 0 || time.Duration(n)*time.Millisecond > echoMaxDelay {
+		return 0, fmt.Errorf("%s must be a positive number no larger than %d", name, echoMaxDelay.Milliseconds())
+	}
+	return time.Duration(n) * time.Millisecond, nil
+}
+
+// Writes the response the way the request asked for. The echo is the body unless a size was given.
+func (e echoShape) write(ctx context.Context, w http.ResponseWriter, echo []byte) error {
+	body, contentType := echo, "application/json"
+	if e.size >= 0 {
+		body, contentType = e.body(), "application/octet-stream"
+	}
+	if e.contentType != "" {
+		contentType = e.contentType
+	}
+
+	if !sleep(ctx, e.delay) {
+		return ctx.Err()
+	}
+
+	for name, values := range e.headers {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	if e.redirect != "" {
+		w.Header().Set("Location", e.redirect)
+	}
+	if e.chunkDelay == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(e.status)
+		_, err := w.Write(body)
+		return err
+	}
+
+	// Without a length the body is sent chunked, one flush per chunk
+	w.WriteHeader(e.status)
+	flusher, _ := w.(http.Flusher)
+	for len(body) > 0 {
+		n := echoChunkSize
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[n:]
+		if len(body) > 0 && !sleep(ctx, e.chunkDelay) {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (e echoShape) body() []byte {
+	if e.fill == "random" {
+		body := make([]byte, e.size)
+		rand.Read(body)
+		return body
+	}
+	return bytes.Repeat([]byte(e.fill), e.size/len(e.fill)+1)[:e.size]
+}
+
+// Waits for d unless the context ends first. Returns whether the full time passed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -1,12 +1,24 @@
 module github.com/plombardi89/qotm
 
-go 1.12
+go 1.17
 
 require (
 	github.com/go-chi/chi v4.0.2+incompatible
+	github.com/golang/protobuf v1.4.2
 	github.com/gorilla/websocket v1.4.0
 	github.com/openzipkin/zipkin-go v0.2.5
 	github.com/plombardi89/gozeug v0.0.0-20190417183658-0b46c5bf7d57
 	github.com/stretchr/testify v1.3.0
-	golang.org/x/net v0.0.0-20190415214537-1da14a5a36f2 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20190415214537-1da14a5a36f2
+	google.golang.org/grpc v1.30.0
+	google.golang.org/protobuf v1.25.0
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	golang.org/x/text v0.3.0 // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
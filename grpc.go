@@ -0,0 +1,337 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/plombardi89/qotm/quotepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// Serves QuoteService and EchoService from the same quotes, hub and server ID as the HTTP endpoints, along with
+// server reflection and the standard health service.
+type grpcServer struct {
+	s *Server
+}
+
+func (s *Server) newGRPCServer(opts ...grpc.ServerOption) (*grpc.Server, *health.Server) {
+	opts = append(opts, grpc.UnaryInterceptor(s.authorizeUnary), grpc.StreamInterceptor(s.authorizeStream))
+	srv := grpc.NewServer(opts...)
+	g := &grpcServer{s: s}
+	quotepb.RegisterQuoteServiceServer(srv, g)
+	quotepb.RegisterEchoServiceServer(srv, g)
+
+	hs := health.NewServer()
+	for name := range srv.GetServiceInfo() {
+		hs.SetServingStatus(name, healthpb.HealthCheckResponse_SERVING)
+	}
+	healthpb.RegisterHealthServer(srv, hs)
+	reflection.Register(srv)
+	return srv, hs
+}
+
+// QuoteService methods need the quotes:read permission like the HTTP routes serving quotes. EchoService, health and
+// reflection stay open like /debug/ and /health.
+const grpcQuoteService = "/qotm.v1.QuoteService/"
+
+// Checks the caller of a gRPC call the way the authorize middleware checks HTTP requests, with the Authorization and
+// API key headers taken from the call's metadata. Calls bridged from gRPC-Web and Connect were already authorized by
+// the middleware and carry its identity.
+func (s *Server) authorizeGRPC(ctx context.Context, method string) (context.Context, error) {
+	if !strings.HasPrefix(method, grpcQuoteService) {
+		return ctx, nil
+	}
+	if identityFromContext(ctx) != nil {
+		return ctx, nil
+	}
+
+	r := &http.Request{Header: http.Header{}, URL: &url.URL{Path: method}}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for name, values := range md {
+		r.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	id, err := s.resolveIdentity(r)
+	if err != nil || (!id.Can(PermQuotesRead) && id.Method == anonymousName) {
+		log.Println("ERROR: Unauthenticated gRPC call: ", method)
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	if !id.Can(PermQuotesRead) {
+		log.Printf("ERROR: %s lacks permission %s for %s\n", id.Name, PermQuotesRead, method)
+		return nil, status.Error(codes.PermissionDenied, "Forbidden")
+	}
+	return context.WithValue(ctx, identityKey{}, id), nil
+}
+
+func (s *Server) authorizeUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authorizeGRPC(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) authorizeStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorizeGRPC(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &identityStream{ServerStream: ss, ctx: ctx})
+}
+
+// Hands the handler of a stream the context carrying the caller's identity
+type identityStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *identityStream) Context() context.Context {
+	return s.ctx
+}
+
+// Sends gRPC calls to the gRPC server and everything else to next. Without TLS the caller wraps the result in h2c
+// so plaintext HTTP/2 reaches it.
+func (s *Server) grpcMux(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && isGRPC(r.Header.Get("Content-Type")) {
+			s.grpc.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Whether the content type is native gRPC, which application/grpc-web is not
+func isGRPC(contentType string) bool {
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+func timestampProto(t time.Time) *tspb.Timestamp {
+	ts, _ := ptypes.TimestampProto(t)
+	return ts
+}
+
+func quoteProto(q QuoteResult) *quotepb.Quote {
+	return &quotepb.Quote{
+		Server:   q.Server,
+		Quote:    q.Quote,
+		Time:     timestampProto(q.Time),
+		Author:   q.Author,
+		Language: q.Language,
+		Tags:     q.Tags,
+	}
+}
+
+// Maps the HTTP status of an error frame to a gRPC code
+func frameStatus(frame *Frame) error {
+	code := codes.Unknown
+	switch frame.Code {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusGone:
+		code = codes.OutOfRange
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, frame.Error)
+}
+
+// Reports why a call's context ended as a status, as a bare context error would reach the client as Unknown
+func contextStatus(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return status.Error(codes.Canceled, ctx.Err().Error())
+}
+
+var errShuttingDown = status.Error(codes.Unavailable, "server shutting down")
+
+// Records where a gRPC client connected from
+func (c *Client) fromPeer(ctx context.Context) *Client {
+	c.transport = TransportGRPC
+	c.connectedAt = time.Now()
+	if p, ok := peer.FromContext(ctx); ok {
+		c.remoteAddr = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("user-agent")) > 0 {
+		c.userAgent = md.Get("user-agent")[0]
+	}
+	return c
+}
+
+func (g *grpcServer) GetQuote(ctx context.Context, req *quotepb.GetQuoteRequest) (*quotepb.Quote, error) {
+	quote := g.s.random.RandomSelectionFromStringSlice(g.s.quotes)
+	return quoteProto(newQuoteResult(g.s.id, quote, g.s.meta)), nil
+}
+
+func (g *grpcServer) StreamQuotes(req *quotepb.StreamQuotesRequest, stream quotepb.QuoteService_StreamQuotesServer) error {
+	interval := defaultInterval
+	if req.IntervalMs != 0 {
+		interval = time.Duration(req.IntervalMs) * time.Millisecond
+		if err := checkInterval(interval); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if req.Room != "" && !roomNamePattern.MatchString(req.Room) {
+		return status.Error(codes.InvalidArgument, "room must be 1 to 64 letters, digits, dashes or underscores")
+	}
+
+	client := newClient(g.s.hub, nil, interval).fromPeer(stream.Context())
+	if f := req.Filter; f != nil {
+		client.filter = Filter{Tags: f.Tags, Author: f.Author, Language: f.Language}
+	}
+	client.roomName = req.Room
+	if !client.hub.enter(client) {
+		return errShuttingDown
+	}
+	defer client.hub.pumps.Done()
+
+	for {
+		select {
+		case frame, ok := <-client.send:
+			if !ok {
+				return errShuttingDown
+			}
+			switch frame.Type {
+			case FrameQuote:
+				quote := quoteProto(*frame.Quote)
+				quote.Seq, quote.Room = frame.Seq, frame.Room
+				if err := stream.Send(quote); err != nil {
+					client.disconnect()
+					return err
+				}
+				atomic.AddInt64(&client.sent, 1)
+			case FrameError:
+				client.disconnect()
+				return frameStatus(frame)
+			}
+		case <-stream.Context().Done():
+			client.disconnect()
+			return contextStatus(stream.Context())
+		}
+	}
+}
+
+func (g *grpcServer) Chat(stream quotepb.QuoteService_ChatServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if !roomNamePattern.MatchString(first.Room) {
+		return status.Error(codes.InvalidArgument, "the first message must name a room of 1 to 64 letters, digits, dashes or underscores")
+	}
+
+	// Chat clients only get chat messages, not the room's quotes
+	client := newClient(g.s.hub, nil, defaultInterval).fromPeer(stream.Context())
+	client.subscribed = false
+	client.roomName = first.Room
+	if !client.hub.enter(client) {
+		return errShuttingDown
+	}
+	defer client.hub.pumps.Done()
+
+	go func() {
+		msg := first
+		for {
+			if msg.Text != "" {
+				client.hub.submit(&control{client: client, msg: &ClientMessage{Type: MsgSay, Text: msg.Text}})
+			}
+			if msg, err = stream.Recv(); err != nil {
+				// The client is done sending, or gone. The hub closes the send channel, which ends the call.
+				client.hub.exit(client)
+				return
+			}
+		}
+	}()
+
+	for frame := range client.send {
+		switch frame.Type {
+		case FrameChat:
+			err := stream.Send(&quotepb.ChatMessage{
+				Room:   frame.Room,
+				Client: frame.Client,
+				Text:   frame.Message,
+				Time:   timestampProto(frame.Time),
+			})
+			if err != nil {
+				client.disconnect()
+				return err
+			}
+			atomic.AddInt64(&client.sent, 1)
+		case FrameError:
+			client.disconnect()
+			return frameStatus(frame)
+		case FrameGoAway:
+			client.disconnect()
+			return errShuttingDown
+		}
+	}
+	return nil
+}
+
+func (g *grpcServer) Echo(ctx context.Context, req *quotepb.EchoRequest) (*quotepb.EchoResponse, error) {
+	res := &quotepb.EchoResponse{
+		Server:   g.s.id,
+		Time:     timestampProto(time.Now().UTC()),
+		Metadata: map[string]*quotepb.MetadataValues{},
+		Body:     req.Body,
+	}
+	res.Method, _ = grpc.Method(ctx)
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	if authority := md.Get(":authority"); len(authority) > 0 {
+		res.Authority = authority[0]
+	}
+	for name, values := range g.s.redactor.header(http.Header(md)) {
+		res.Metadata[strings.ToLower(name)] = &quotepb.MetadataValues{Values: values}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		res.Peer = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := debugTLS(&info.State)
+			res.Tls = &quotepb.EchoTLS{
+				Version:            state.Version,
+				CipherSuite:        state.CipherSuite,
+				ServerName:         state.ServerName,
+				NegotiatedProtocol: state.NegotiatedProtocol,
+			}
+			for _, cert := range state.PeerCertificates {
+				res.Tls.PeerCertificates = append(res.Tls.PeerCertificates, cert.Subject)
+			}
+		}
+	}
+
+	log.Printf("gRPC echo %s from %s\n", res.Method, res.Peer)
+	return res, nil
+}
@@ -0,0 +1,365 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/plombardi89/gozeug/randomzeug"
+	"github.com/plombardi89/qotm/quotepb"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestGRPCServer(t *testing.T) (*Server, *grpc.ClientConn) {
+	s := &Server{
+		id:     "test-server",
+		quotes: []string{"funny"},
+		meta: map[string]QuoteMeta{
+			"funny": {Author: "Alice", Language: "en", Tags: []string{"humor"}},
+		},
+		random:   randomzeug.NewRandom(),
+		wsOpts:   defaultWSOptions(),
+		redactor: newTestRedactor(t),
+	}
+	s.hub = newHub(s.random, s.quotes, s.meta, s.id)
+	go s.hub.run()
+
+	// Shares the port with a plain handler the way Start does without GRPC_PORT
+	s.grpc, s.grpcHealth = s.newGRPCServer()
+	ts := httptest.NewServer(h2c.NewHandler(s.grpcMux(http.NotFoundHandler()), &http2.Server{}))
+	t.Cleanup(ts.Close)
+
+	conn, err := grpc.Dial(strings.TrimPrefix(ts.URL, "http://"), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+func TestGRPC_Quotes(t *testing.T) {
+	_, conn := newTestGRPCServer(t)
+	client := quotepb.NewQuoteServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	quote, err := client.GetQuote(ctx, &quotepb.GetQuoteRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "funny", quote.Quote)
+		assert.Equal(t, "Alice", quote.Author)
+		assert.Equal(t, "test-server", quote.Server)
+	}
+
+	stream, err := client.StreamQuotes(ctx, &quotepb.StreamQuotesRequest{IntervalMs: 100, Room: "lobby"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for seq := uint64(1); seq <= 2; seq++ {
+		quote, err := stream.Recv()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "funny", quote.Quote)
+			assert.Equal(t, "lobby", quote.Room)
+			assert.Equal(t, seq, quote.Seq)
+		}
+	}
+
+	stream, err = client.StreamQuotes(ctx, &quotepb.StreamQuotesRequest{IntervalMs: 1})
+	if assert.NoError(t, err) {
+		_, err = stream.Recv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestGRPC_Authorize(t *testing.T) {
+	s, conn := newTestGRPCServer(t)
+	s.auth = newTestAuthenticator(t)
+	s.policy = defaultPolicy(false)
+	s.policy.Anonymous = nil
+	client := quotepb.NewQuoteServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.GetQuote(ctx, &quotepb.GetQuoteRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	stream, err := client.StreamQuotes(ctx, &quotepb.StreamQuotesRequest{IntervalMs: 100})
+	if assert.NoError(t, err) {
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+
+	basic := func(password string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("viewer:"+password)))
+	}
+	_, err = client.GetQuote(basic("wrong"), &quotepb.GetQuoteRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	quote, err := client.GetQuote(basic("hunter2"), &quotepb.GetQuoteRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "funny", quote.Quote)
+	}
+
+	// Echo stays open like /debug/
+	_, err = quotepb.NewEchoServiceClient(conn).Echo(ctx, &quotepb.EchoRequest{})
+	assert.NoError(t, err)
+}
+
+func TestGRPC_Chat(t *testing.T) {
+	_, conn := newTestGRPCServer(t)
+	client := quotepb.NewQuoteServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	alice, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, alice.Send(&quotepb.ChatMessage{Room: "lobby"}))
+	assert.NoError(t, bob.Send(&quotepb.ChatMessage{Room: "lobby"}))
+
+	// Bob has to be in the room before alice is heard, which the hub does not report, so she keeps saying hello
+	received := make(chan *quotepb.ChatMessage, 1)
+	go func() {
+		if msg, err := bob.Recv(); err == nil {
+			received <- msg
+		}
+	}()
+	var msg *quotepb.ChatMessage
+	for msg == nil {
+		assert.NoError(t, alice.Send(&quotepb.ChatMessage{Text: "hello"}))
+		select {
+		case msg = <-received:
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("bob never heard alice")
+		}
+	}
+	assert.Equal(t, "lobby", msg.Room)
+	assert.Equal(t, "hello", msg.Text)
+	assert.NotEmpty(t, msg.Client)
+
+	stream, err := client.Chat(ctx)
+	if assert.NoError(t, err) {
+		assert.NoError(t, stream.Send(&quotepb.ChatMessage{Room: "not a room"}))
+		_, err = stream.Recv()
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestGRPC_EchoAndHealth(t *testing.T) {
+	s, conn := newTestGRPCServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret-token", "x-trace", "abc")
+	res, err := quotepb.NewEchoServiceClient(conn).Echo(ctx, &quotepb.EchoRequest{Body: []byte("ping")})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "test-server", res.Server)
+		assert.Equal(t, "/qotm.v1.EchoService/Echo", res.Method)
+		assert.Equal(t, []byte("ping"), res.Body)
+		assert.Equal(t, []string{"abc"}, res.Metadata["x-trace"].Values)
+		assert.NotContains(t, res.Metadata["authorization"].Values[0], "secret-token")
+		assert.Nil(t, res.Tls)
+	}
+
+	health := healthpb.NewHealthClient(conn)
+	for _, service := range []string{"", "qotm.v1.QuoteService", "qotm.v1.EchoService"} {
+		check, err := health.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if assert.NoError(t, err) {
+			assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check.Status, service)
+		}
+	}
+
+	s.grpcHealth.Shutdown()
+	check, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check.Status)
+	}
+}
+
+// Serves the gRPC-Web and Connect routes over plain HTTP/1.1, the way browsers reach them
+func newTestRPCServer(t *testing.T) *httptest.Server {
+	s, _ := newTestGRPCServer(t)
+	s.corsOrigins = []string{"https://demo.example.com"}
+	router := chi.NewRouter()
+	router.With(s.rpcCORS).HandleFunc("/qotm.v1.QuoteService/{method}", s.ServeRPC)
+	router.With(s.rpcCORS).HandleFunc("/qotm.v1.EchoService/{method}", s.ServeRPC)
+	ts := httptest.NewServer(router)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func postRPC(t *testing.T, url, contentType string, body []byte, header ...string) *http.Response {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// Splits a body into its length prefixed frames
+func readFrames(t *testing.T, body []byte) (flags []byte, msgs [][]byte) {
+	for len(body) > 0 {
+		if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) > len(body)-5 {
+			t.Fatalf("truncated frame %q", body)
+		}
+		n := 5 + binary.BigEndian.Uint32(body[1:5])
+		flags, msgs = append(flags, body[0]), append(msgs, body[5:n])
+		body = body[n:]
+	}
+	return flags, msgs
+}
+
+func TestGRPCWeb(t *testing.T) {
+	ts := newTestRPCServer(t)
+
+	res := postRPC(t, ts.URL+"/qotm.v1.QuoteService/GetQuote", "application/grpc-web+proto", envelope(0, nil))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/grpc-web+proto", res.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(res.Body)
+	flags, msgs := readFrames(t, body)
+	if assert.Equal(t, []byte{0, grpcWebTrailerFlag}, flags) {
+		quote := &quotepb.Quote{}
+		assert.NoError(t, proto.Unmarshal(msgs[0], quote))
+		assert.Equal(t, "funny", quote.Quote)
+		assert.Equal(t, "grpc-status: 0\r\n", string(msgs[1]))
+	}
+
+	// The text variant with JSON messages, streaming until the deadline the client set
+	req := base64.StdEncoding.EncodeToString(envelope(0, []byte(`{"intervalMs": 100}`)))
+	res = postRPC(t, ts.URL+"/qotm.v1.QuoteService/StreamQuotes", "application/grpc-web-text+json", []byte(req), "Grpc-Timeout", "250m")
+	assert.Equal(t, "application/grpc-web-text+json", res.Header.Get("Content-Type"))
+	text, _ := ioutil.ReadAll(res.Body)
+	// Every write is encoded with its own padding, so clients decode 4 bytes at a time
+	var decoded []byte
+	for i := 0; i+4 <= len(text); i += 4 {
+		part, err := base64.StdEncoding.DecodeString(string(text[i : i+4]))
+		if !assert.NoError(t, err) {
+			return
+		}
+		decoded = append(decoded, part...)
+	}
+	assert.Zero(t, len(text)%4)
+	flags, msgs = readFrames(t, decoded)
+	if assert.Equal(t, []byte{0, 0, grpcWebTrailerFlag}, flags) {
+		assert.Contains(t, string(msgs[0]), `"quote":"funny"`)
+		assert.Contains(t, string(msgs[2]), "grpc-status: 4\r\n")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	ts := newTestRPCServer(t)
+
+	res := postRPC(t, ts.URL+"/qotm.v1.QuoteService/GetQuote", "application/json", []byte(`{}`))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	quote := map[string]interface{}{}
+	if assert.NoError(t, json.NewDecoder(res.Body).Decode(&quote)) {
+		assert.Equal(t, "funny", quote["quote"])
+		assert.Equal(t, "test-server", quote["server"])
+	}
+
+	msg, _ := proto.Marshal(&quotepb.EchoRequest{Body: []byte("ping")})
+	res = postRPC(t, ts.URL+"/qotm.v1.EchoService/Echo", "application/proto", msg, "Authorization", "Bearer secret-token")
+	assert.Equal(t, "application/proto", res.Header.Get("Content-Type"))
+	body, _ := ioutil.ReadAll(res.Body)
+	echo := &quotepb.EchoResponse{}
+	if assert.NoError(t, proto.Unmarshal(body, echo)) {
+		assert.Equal(t, "/qotm.v1.EchoService/Echo", echo.Method)
+		assert.Equal(t, []byte("ping"), echo.Body)
+		assert.NotContains(t, echo.Metadata["authorization"].Values[0], "secret-token")
+	}
+
+	// Streams frame their messages and end with the status as JSON
+	res = postRPC(t, ts.URL+"/qotm.v1.QuoteService/StreamQuotes", "application/connect+json", envelope(0, []byte(`{"intervalMs": 1}`)))
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/connect+json", res.Header.Get("Content-Type"))
+	body, _ = ioutil.ReadAll(res.Body)
+	flags, msgs := readFrames(t, body)
+	if assert.Equal(t, []byte{connectEndStreamFlag}, flags) {
+		assert.JSONEq(t, `{"error": {"code": "invalid_argument", "message": "interval_ms must be between 100 and 3600000"}}`, string(msgs[0]))
+	}
+
+	res = postRPC(t, ts.URL+"/qotm.v1.QuoteService/StreamQuotes", "application/json", []byte(`{}`))
+	assert.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+
+	res = postRPC(t, ts.URL+"/qotm.v1.QuoteService/Missing", "application/json", []byte(`{}`))
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.JSONEq(t, `{"code": "unimplemented", "message": "unknown method /qotm.v1.QuoteService/Missing"}`, string(body))
+}
+
+func TestRPC_CORS(t *testing.T) {
+	ts := newTestRPCServer(t)
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", ts.URL+"/qotm.v1.EchoService/Echo", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := preflight("https://demo.example.com")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "https://demo.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", res.Header.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "POST", res.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "content-type,x-grpc-web", res.Header.Get("Access-Control-Allow-Headers"))
+
+	res = preflight("https://evil.example.com")
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+
+	res = postRPC(t, ts.URL+"/qotm.v1.EchoService/Echo", "application/json", []byte(`{}`), "Origin", "https://demo.example.com")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "https://demo.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, res.Header.Get("Access-Control-Expose-Headers"), "Grpc-Status")
+}
@@ -0,0 +1,330 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	contentTypeGRPCWeb     = "application/grpc-web"
+	contentTypeGRPCWebText = "application/grpc-web-text"
+
+	// Flag of the length prefixed frame that carries the trailers at the end of a gRPC-Web response
+	grpcWebTrailerFlag = 0x80
+
+	// Headers browsers may read from gRPC-Web and Connect responses
+	rpcExposedHeaders = "Grpc-Status, Grpc-Message, Grpc-Status-Details-Bin"
+
+	// How long browsers may cache a preflight answer
+	rpcCORSMaxAge = 2 * time.Hour
+)
+
+func init() {
+	// Lets the bridged protocols, and native gRPC clients, send messages as JSON
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// Encodes messages with the canonical protobuf JSON mapping, for the application/grpc+json content type
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as JSON", v)
+	}
+	return protojson.Marshal(msg)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("cannot decode JSON into %T", v)
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, msg)
+}
+
+// Returns the codec named by a content type such as application/grpc-web+json. No suffix means proto.
+func rpcCodec(mediaType, prefix string) (string, bool) {
+	switch strings.TrimPrefix(mediaType, prefix) {
+	case "", "+proto":
+		return "proto", true
+	case "+json":
+		return "json", true
+	}
+	return "", false
+}
+
+// A response writer for gRPC calls that arrived in another protocol. The gRPC server writes to it as if it spoke
+// HTTP/2: start gets the status and headers before anything else, the length prefixed messages go to out and the
+// trailers are left in the header for trailers to read once the call is over.
+type grpcRecorder struct {
+	header  http.Header
+	started bool
+	start   func(status int, header http.Header)
+	out     io.Writer
+	flush   func()
+}
+
+func newGRPCRecorder(out io.Writer, start func(int, http.Header)) *grpcRecorder {
+	return &grpcRecorder{header: http.Header{}, out: out, start: start}
+}
+
+func (g *grpcRecorder) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcRecorder) WriteHeader(status int) {
+	if g.started {
+		return
+	}
+	g.started = true
+
+	header := http.Header{}
+	for name, values := range g.header {
+		switch name {
+		case "Content-Type", "Content-Length", "Date", "Trailer":
+		default:
+			header[name] = values
+		}
+	}
+	g.start(status, header)
+}
+
+func (g *grpcRecorder) Write(p []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	return g.out.Write(p)
+}
+
+func (g *grpcRecorder) Flush() {
+	g.WriteHeader(http.StatusOK)
+	if g.flush != nil {
+		g.flush()
+	}
+}
+
+// Returns the status and the trailers the call ended with, leaving out the grpc-* ones
+func (g *grpcRecorder) trailers() (*status.Status, http.Header) {
+	trailers := http.Header{}
+	for name, values := range g.header {
+		if strings.HasPrefix(name, http2.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(name, http2.TrailerPrefix))] = values
+		}
+	}
+
+	code, err := strconv.Atoi(g.header.Get("Grpc-Status"))
+	if err != nil {
+		return status.New(codes.Internal, "the call ended without a status"), trailers
+	}
+	msg, err := url.PathUnescape(g.header.Get("Grpc-Message"))
+	if err != nil {
+		msg = g.header.Get("Grpc-Message")
+	}
+	return status.New(codes.Code(code), msg), trailers
+}
+
+// Runs r against the gRPC server as a native gRPC call with the given content type and body. A timeout in the
+// grpc-timeout format replaces the one the request carries.
+func (s *Server) callGRPC(rec *grpcRecorder, r *http.Request, contentType string, body io.Reader, timeout string) {
+	call := r.Clone(r.Context())
+	call.ProtoMajor, call.ProtoMinor, call.Proto = 2, 0, "HTTP/2.0"
+	call.Header.Set("Content-Type", contentType)
+	call.Header.Del("Content-Length")
+	if timeout != "" {
+		call.Header.Set("Grpc-Timeout", timeout)
+	}
+	call.ContentLength = -1
+	call.Body = ioutil.NopCloser(body)
+	s.grpc.ServeHTTP(rec, call)
+}
+
+// Wraps a message in the length prefixed frame gRPC, gRPC-Web and Connect streams share
+func envelope(flags byte, msg []byte) []byte {
+	frame := make([]byte, 5+len(msg))
+	frame[0] = flags
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	return frame
+}
+
+// Serves the gRPC services to gRPC-Web and Connect clients through the router, so browsers can call them without a
+// proxy translating to native gRPC. Native gRPC calls never get here, see grpcMux.
+func (s *Server) ServeRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "gRPC-Web and Connect calls must be POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.grpc == nil {
+		http.Error(w, "gRPC is not serving", http.StatusServiceUnavailable)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(mediaType, contentTypeGRPCWeb):
+		s.serveGRPCWeb(w, r, mediaType)
+	case mediaType == "application/proto" || mediaType == "application/json":
+		s.serveConnectUnary(w, r, strings.TrimPrefix(mediaType, "application/"))
+	case strings.HasPrefix(mediaType, contentTypeConnectStream):
+		s.serveConnectStream(w, r, mediaType)
+	default:
+		http.Error(w, "expected a gRPC-Web or Connect content type", http.StatusUnsupportedMediaType)
+	}
+}
+
+// Translates a gRPC-Web call. The messages pass through as they are, base64 encoded for the -text variant, and the
+// trailers follow in a final frame of their own.
+func (s *Server) serveGRPCWeb(w http.ResponseWriter, r *http.Request, mediaType string) {
+	text := strings.HasPrefix(mediaType, contentTypeGRPCWebText)
+	prefix := contentTypeGRPCWeb
+	if text {
+		prefix = contentTypeGRPCWebText
+	}
+	codec, ok := rpcCodec(mediaType, prefix)
+	if !ok {
+		http.Error(w, "gRPC-Web messages must be proto or json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = r.Body
+	var out io.Writer = w
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, r.Body)
+		out = base64Chunks{w}
+	}
+
+	rec := newGRPCRecorder(out, func(code int, header http.Header) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Type", prefix+"+"+codec)
+		w.WriteHeader(code)
+	})
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		rec.flush = flusher.Flush
+	}
+	s.callGRPC(rec, r, "application/grpc+"+codec, body, "")
+
+	st, trailers := rec.trailers()
+	trailers.Set("Grpc-Status", strconv.Itoa(int(st.Code())))
+	if st.Message() != "" {
+		trailers.Set("Grpc-Message", rec.header.Get("Grpc-Message"))
+	}
+	if details := rec.header.Get("Grpc-Status-Details-Bin"); details != "" {
+		trailers.Set("Grpc-Status-Details-Bin", details)
+	}
+	rec.Write(grpcWebTrailers(trailers))
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// Encodes trailers as the HTTP/1 style header block of a gRPC-Web trailer frame, with lower case names
+func grpcWebTrailers(trailers http.Header) []byte {
+	names := make([]string, 0, len(trailers))
+	for name := range trailers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var block bytes.Buffer
+	for _, name := range names {
+		for _, v := range trailers[name] {
+			fmt.Fprintf(&block, "%s: %s\r\n", strings.ToLower(name), v)
+		}
+	}
+	return envelope(grpcWebTrailerFlag, block.Bytes())
+}
+
+// Base64 encodes every write on its own, padding included, as gRPC-Web text clients decode the stream in
+// 4 byte groups
+type base64Chunks struct {
+	w io.Writer
+}
+
+func (b base64Chunks) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(b.w, base64.StdEncoding.EncodeToString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Answers CORS preflights for the gRPC-Web and Connect routes and lets the origins in RPC_CORS_ORIGINS read the
+// responses. Requests from other origins go through untouched, so browsers refuse them.
+func (s *Server) rpcCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		wildcard, allowed := s.corsOrigin(origin)
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !wildcard {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+			w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(rpcCORSMaxAge.Seconds())))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", rpcExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns whether the origin may call the RPC routes, and whether that is only because every origin may
+func (s *Server) corsOrigin(origin string) (wildcard bool, allowed bool) {
+	if origin == "" {
+		return false, false
+	}
+	for _, o := range s.corsOrigins {
+		if o == "*" {
+			return true, true
+		}
+		if strings.EqualFold(o, origin) {
+			return false, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"unicode/utf8"
+)
+
+// The subset of HAR 1.2 (http://www.softwareishard.com/blog/har-12-spec/) needed to describe the request history.
+// Timings are not broken down, the whole duration counts as waiting.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Comment string `json:"comment,omitempty"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harEntry(e *HistoryEntry) HAREntry {
+	scheme := "http"
+	if e.TLS != nil {
+		scheme = "https"
+	}
+	reqHeader, resHeader := http.Header(e.Headers), http.Header(e.ResponseHeaders)
+
+	entry := HAREntry{
+		StartedDateTime: e.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Time:            e.DurationMS,
+		Request: HARRequest{
+			Method:      e.Method,
+			URL:         (&url.URL{Scheme: scheme, Host: e.Host}).String() + e.URL,
+			HTTPVersion: e.Proto,
+			Cookies:     []HARCookie{},
+			Headers:     harHeaders(reqHeader),
+			QueryString: []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    e.ContentLength,
+		},
+		Response: HARResponse{
+			Status:      e.Status,
+			StatusText:  http.StatusText(e.Status),
+			HTTPVersion: e.Proto,
+			Cookies:     []HARCookie{},
+			Headers:     harHeaders(resHeader),
+			Content: HARContent{
+				Size:     e.ResponseSize,
+				MimeType: resHeader.Get("Content-Type"),
+			},
+			RedirectURL: resHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    e.ResponseSize,
+		},
+		Timings: HARTimings{Wait: e.DurationMS},
+		Comment: e.RequestID,
+	}
+
+	for _, c := range (&http.Request{Header: reqHeader}).Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, HARCookie{Name: c.Name, Value: c.Value})
+	}
+	for _, c := range (&http.Response{Header: resHeader}).Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, HARCookie{
+			Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure,
+		})
+	}
+
+	names := make([]string, 0, len(e.Query))
+	for name := range e.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range e.Query[name] {
+			entry.Request.QueryString = append(entry.Request.QueryString, HARNameValue{Name: name, Value: v})
+		}
+	}
+
+	if e.Body != "" {
+		mediaType, _, _ := mime.ParseMediaType(reqHeader.Get("Content-Type"))
+		entry.Request.PostData = &HARPostData{MimeType: mediaType}
+		// HAR has no encoding for request bodies, so the comment says how the text was encoded
+		text, encoding := harText(e.Body)
+		entry.Request.PostData.Text = text
+		if encoding != "" {
+			entry.Request.PostData.Comment = "encoding: " + encoding
+		}
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harText(e.ResponseBody)
+	if e.ResponseBodyTruncated {
+		entry.Response.Content.Comment = "truncated"
+	}
+	return entry
+}
+
+// Returns a body as HAR text along with its encoding. Bodies that are not valid UTF-8 would come out mangled in JSON,
+// so they are base64 encoded.
+func harText(body string) (string, string) {
+	if utf8.ValidString(body) {
+		return body, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(body)), "base64"
+}
+
+// Flattens a header into name/value pairs sorted by name
+func harHeaders(header http.Header) []HARNameValue {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []HARNameValue{}
+	for _, name := range names {
+		for _, v := range header[name] {
+			pairs = append(pairs, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return pairs
+}
+
+// Exports the recorded requests as a HAR 1.2 log, oldest first. Takes the same filters as /debug/history.
+func (s *Server) GetHistoryHAR(w http.ResponseWriter, r *http.Request) {
+	limit, ok := historyLimit(r)
+	if !ok {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	recorded := s.redactor.entries(s.history.list(historyFilter(r), limit))
+	har := HAR{Log: HARLog{Version: "1.2", Creator: HARCreator{Name: "qotm", Version: "0.1.0", Comment: s.id}, Entries: []HAREntry{}}}
+	for i := len(recorded) - 1; i >= 0; i-- {
+		har.Log.Entries = append(har.Log.Entries, harEntry(recorded[i]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.har"`)
+	if err := json.NewEncoder(w).Encode(har); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+const (
+	defaultHistorySize = 100
+
+	// Only the start of each request and response body is kept so uploads and streams do not fill the history
+	historyMaxBody = 64 << 10
+
+	// How often the history page reloads itself unless the request says otherwise
+	defaultHistoryRefresh = 5
+
+	// Probes that would otherwise push every other request out of the history
+	defaultHistorySkip = "/health"
+)
+
+// A request handled by the server, recorded once the handler returned. Stream requests show up when they end.
+type HistoryEntry struct {
+	ID                    uint64              `json:"id"`
+	RequestID             string              `json:"request_id,omitempty"`
+	Time                  time.Time           `json:"time"`
+	DurationMS            float64             `json:"duration_ms"`
+	Method                string              `json:"method"`
+	Host                  string              `json:"host"`
+	Proto                 string              `json:"proto"`
+	Path                  string              `json:"path"`
+	URL                   string              `json:"url"`
+	Route                 string              `json:"route,omitempty"`
+	Query                 map[string][]string `json:"query"`
+	RemoteAddr            string              `json:"remoteaddr"`
+	Headers               map[string][]string `json:"headers"`
+	ContentLength         int64               `json:"content_length"`
+	Body                  string              `json:"body"`
+	BodyTruncated         bool                `json:"body_truncated,omitempty"`
+	Trailers              map[string][]string `json:"trailers,omitempty"`
+	TLS                   *DebugTLS           `json:"tls,omitempty"`
+	Status                int                 `json:"status"`
+	ResponseHeaders       map[string][]string `json:"response_headers"`
+	ResponseSize          int                 `json:"response_size"`
+	ResponseBody          string              `json:"response_body"`
+	ResponseBodyTruncated bool                `json:"response_body_truncated,omitempty"`
+}
+
+// Keeps the last requests in a ring, oldest first from next
+type requestHistory struct {
+	mu      sync.Mutex
+	entries []*HistoryEntry
+	next    int
+	lastID  uint64
+
+	// Paths that are never recorded
+	skip map[string]bool
+}
+
+// Returns a history of the last size requests, leaving out requests for the skipped paths. A size of zero disables
+// recording.
+func newRequestHistory(size int, skip []string) *requestHistory {
+	h := &requestHistory{entries: make([]*HistoryEntry, 0, size), skip: map[string]bool{}}
+	for _, path := range skip {
+		h.skip[path] = true
+	}
+	return h
+}
+
+func (h *requestHistory) add(e *HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	e.ID = h.lastID
+	if len(h.entries) < cap(h.entries) {
+		h.entries = append(h.entries, e)
+		return
+	}
+	h.entries[h.next] = e
+	h.next = (h.next + 1) % len(h.entries)
+}
+
+func (h *requestHistory) get(id uint64) (*HistoryEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range h.entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the entries that match, newest first, up to limit when it is positive
+func (h *requestHistory) list(match func(*HistoryEntry) bool, limit int) []*HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := []*HistoryEntry{}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[(h.next+i)%len(h.entries)]
+		if !match(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+	}
+	return entries
+}
+
+// Middleware that records every request except those for skipped paths and those that read or replay the history
+func (h *requestHistory) record(next http.Handler) http.Handler {
+	if cap(h.entries) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.skip[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/debug/history") || strings.HasPrefix(r.URL.Path, "/debug/replay/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		e := &HistoryEntry{
+			RequestID:     middleware.GetReqID(r.Context()),
+			Time:          time.Now().UTC(),
+			Method:        r.Method,
+			Host:          r.Host,
+			Proto:         r.Proto,
+			Path:          r.URL.Path,
+			URL:           r.URL.RequestURI(),
+			Query:         r.URL.Query(),
+			RemoteAddr:    r.RemoteAddr,
+			Headers:       r.Header.Clone(),
+			ContentLength: r.ContentLength,
+			TLS:           debugTLS(r.TLS),
+		}
+
+		var body *bodyRecorder
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &bodyRecorder{ReadCloser: r.Body, buf: cappedBuffer{limit: historyMaxBody}}
+			r.Body = body
+		}
+
+		response := cappedBuffer{limit: historyMaxBody}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(&response)
+		next.ServeHTTP(ww, r)
+
+		e.DurationMS = float64(time.Since(e.Time).Microseconds()) / 1000
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			e.Route = rctx.RoutePattern()
+		}
+		if body != nil {
+			e.Body, e.BodyTruncated = body.buf.String(), body.buf.truncated
+		}
+		if len(r.Trailer) > 0 {
+			e.Trailers = r.Trailer.Clone()
+		}
+		e.Status = ww.Status()
+		if e.Status == 0 {
+			// Nothing was written, or the connection was hijacked for a websocket
+			e.Status = http.StatusOK
+		}
+		e.ResponseHeaders = w.Header().Clone()
+		// Counted here rather than with BytesWritten, which counts io.ReaderFrom copies twice once teed
+		e.ResponseSize = response.size
+		e.ResponseBody, e.ResponseBodyTruncated = response.String(), response.truncated
+		h.add(e)
+	})
+}
+
+// Keeps the first limit bytes written to it and counts the rest. Write is the only way in, so io.Copy and
+// io.WriteString cannot get around the limit through ReadFrom or WriteString.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	size      int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.size += len(p)
+	keep := len(p)
+	if room := b.limit - b.buf.Len(); keep > room {
+		keep = room
+		b.truncated = true
+	}
+	b.buf.Write(p[:keep])
+	return len(p), nil
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *cappedBuffer) String() string {
+	return b.buf.String()
+}
+
+// Keeps the start of a request body as the handler reads it
+type bodyRecorder struct {
+	io.ReadCloser
+	buf cappedBuffer
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+// Builds a matcher from the `path`, `method` and `header` query parameters. Path matches as a prefix. Header is
+// either a name the request must carry or `Name: value`, where value must appear in one of its values.
+func historyFilter(r *http.Request) func(*HistoryEntry) bool {
+	query := r.URL.Query()
+	path, method := query.Get("path"), query.Get("method")
+	headerName, headerValue := query.Get("header"), ""
+	if i := strings.Index(headerName, ":"); i >= 0 {
+		headerName, headerValue = strings.TrimSpace(headerName[:i]), strings.TrimSpace(headerName[i+1:])
+	}
+
+	return func(e *HistoryEntry) bool {
+		if path != "" && !strings.HasPrefix(e.Path, path) {
+			return false
+		}
+		if method != "" && !strings.EqualFold(e.Method, method) {
+			return false
+		}
+		if headerName == "" {
+			return true
+		}
+		values, ok := http.Header(e.Headers)[http.CanonicalHeaderKey(headerName)]
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if strings.Contains(v, headerValue) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func historyLimit(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
+}
+
+// Lists the recorded requests as JSON, newest first
+func (s *Server) GetHistory(w http.ResponseWriter, r *http.Request) {
+	limit, ok := historyLimit(r)
+	if !ok {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.redactor.entries(s.history.list(historyFilter(r), limit))); err != nil {
+		log.Println(err)
+	}
+}
+
+// Renders the recorded requests as a page that reloads itself every `refresh` seconds
+func (s *Server) HistoryPage(w http.ResponseWriter, r *http.Request) {
+	limit, ok := historyLimit(r)
+	if !ok {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+	refresh := defaultHistoryRefresh
+	if v := r.URL.Query().Get("refresh"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "refresh must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+		refresh = n
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	err := s.templates.ExecuteTemplate(w, "history.html", map[string]interface{}{
+		"Entries": s.redactor.entries(s.history.list(historyFilter(r), limit)),
+		"Path":    r.URL.Query().Get("path"),
+		"Method":  r.URL.Query().Get("method"),
+		"Header":  r.URL.Query().Get("header"),
+		"Limit":   r.URL.Query().Get("limit"),
+		"Refresh": refresh,
+	})
+	if err != nil {
+		log.Println("ERROR: Could not render history page: ", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Send keep-alives to plain HTTP stream clients with this period so proxies keep the connection open.
+	keepAliveInterval = 15 * time.Second
+
+	// How long a long-poll request waits for a quote when the client does not say.
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+)
+
+// Writes frames from the hub to a plain HTTP response until the request is cancelled or the hub drops the client.
+// KeepAlive is called when nothing has been written for a while and can be nil.
+func (c *Client) flushPump(ctx context.Context, flusher http.Flusher, write func(*Frame) error, keepAlive func() error) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer func() {
+		ticker.Stop()
+		c.hub.pumps.Done()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-c.send:
+			if !ok {
+				// The hub closed the channel.
+				return
+			}
+			if err := write(frame); err != nil {
+				c.disconnect()
+				return
+			}
+			flusher.Flush()
+			atomic.AddInt64(&c.sent, 1)
+		case <-ticker.C:
+			if keepAlive == nil {
+				continue
+			}
+			if err := keepAlive(); err != nil {
+				c.disconnect()
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			log.Println("stream closed by client")
+			c.disconnect()
+			return
+		}
+	}
+}
+
+// Unregisters the client and waits for the hub to close its channel
+func (c *Client) disconnect() {
+	c.hub.exit(c)
+	for range c.send {
+	}
+}
+
+// Streams frames from the hub as newline delimited JSON over a chunked response
+func (s *Server) StreamNDJSON(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	params, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := newClient(s.hub, nil, params.interval).from(r, TransportNDJSON)
+	client.filter = params.filter
+	client.overflow = params.overflow
+	if !client.hub.enter(client) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client.flushPump(r.Context(), flusher, func(frame *Frame) error {
+		_, err := w.Write(append(frame.Marshal(), '\n'))
+		return err
+	}, nil)
+}
+
+// Long-polls the hub for quotes. Responds with a JSON array of quote frames as soon as there is at least one, or with
+// 204 when none arrived before the timeout. No quotes are picked for a client between polls, so there is nothing to
+// catch up on.
+func (s *Server) PollQuotes(w http.ResponseWriter, r *http.Request) {
+	params, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := newClient(s.hub, nil, params.interval).from(r, TransportPoll)
+	client.filter = params.filter
+	client.overflow = params.overflow
+
+	timeout := defaultPollTimeout
+	if ms := r.URL.Query().Get("timeout_ms"); ms != "" {
+		n, err := strconv.Atoi(ms)
+		if err != nil || n <= 0 || time.Duration(n)*time.Millisecond > maxPollTimeout {
+			http.Error(w, "timeout_ms must be a positive number no larger than "+strconv.FormatInt(maxPollTimeout.Milliseconds(), 10), http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(n) * time.Millisecond
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	if !client.hub.enter(client) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	frames := client.poll(ctx)
+	client.disconnect()
+	client.hub.pumps.Done()
+
+	if len(frames) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(frames)
+}
+
+// Waits for the first quote frame and returns it with any others already queued
+func (c *Client) poll(ctx context.Context) []*Frame {
+	var frames []*Frame
+	for len(frames) == 0 {
+		select {
+		case frame, ok := <-c.send:
+			if !ok {
+				return frames
+			}
+			if frame.Type == FrameQuote {
+				frames = append(frames, frame)
+			}
+		case <-ctx.Done():
+			return frames
+		}
+	}
+
+	for {
+		select {
+		case frame, ok := <-c.send:
+			if !ok {
+				return frames
+			}
+			if frame.Type == FrameQuote {
+				frames = append(frames, frame)
+			}
+		default:
+			return frames
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	xsrfCookiePrefix    = "ambassador_xsrf."
+	sessionCookiePrefix = "ambassador_session."
+
+	// Remembers the realms the logout page showed last, so it can tell which ones the gateway logged out when its
+	// post-logout redirect comes back without ?logged_out=
+	logoutRealmsCookie = "qotm_logout_realms"
+)
+
+// A realm the caller is logged in to, with the claims of its session cookie when that cookie is a JWT
+type Realm struct {
+	Name    string
+	XSRF    string
+	Claims  map[string]interface{}
+	Expires time.Time
+	Expired bool
+}
+
+// Decodes the payload of a JWT without verifying it. The gateway has already done that; we only want to show it.
+func decodeJWTClaims(token string) (map[string]interface{}, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, false
+	}
+
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, false
+	}
+	return claims, true
+}
+
+func realmsFromCookies(cookies []*http.Cookie, now time.Time) []*Realm {
+	sessions := make(map[string]string)
+	for _, cookie := range cookies {
+		if strings.HasPrefix(cookie.Name, sessionCookiePrefix) {
+			sessions[strings.TrimPrefix(cookie.Name, sessionCookiePrefix)] = cookie.Value
+		}
+	}
+
+	var realms []*Realm
+	for _, cookie := range cookies {
+		if !strings.HasPrefix(cookie.Name, xsrfCookiePrefix) {
+			continue
+		}
+
+		realm := &Realm{Name: strings.TrimPrefix(cookie.Name, xsrfCookiePrefix), XSRF: cookie.Value}
+		if claims, ok := decodeJWTClaims(sessions[realm.Name]); ok {
+			realm.Claims = claims
+			if exp, ok := claims["exp"].(float64); ok {
+				realm.Expires = time.Unix(int64(exp), 0).UTC()
+				realm.Expired = realm.Expires.Before(now)
+			}
+		}
+		realms = append(realms, realm)
+	}
+
+	sort.Slice(realms, func(i, j int) bool {
+		return realms[i].Name < realms[j].Name
+	})
+	return realms
+}
+
+// Works out which realms were logged out since the page was last shown. The gateway's post-logout redirect can say
+// so with ?logged_out=<realm> (or "all"); without it the realms remembered from the last visit that no longer have
+// cookies are the ones logged out.
+func loggedOutRealms(r *http.Request, realms []*Realm) string {
+	if v := r.URL.Query().Get("logged_out"); v != "" {
+		return v
+	}
+	cookie, err := r.Cookie(logoutRealmsCookie)
+	if err != nil {
+		return ""
+	}
+	remembered, err := url.QueryUnescape(cookie.Value)
+	if err != nil || remembered == "" {
+		return ""
+	}
+
+	current := make(map[string]bool)
+	for _, realm := range realms {
+		current[realm.Name] = true
+	}
+	var gone []string
+	for _, name := range strings.Split(remembered, ",") {
+		if !current[name] {
+			gone = append(gone, name)
+		}
+	}
+	if len(gone) > 1 && len(realms) == 0 {
+		return "all"
+	}
+	return strings.Join(gone, ", ")
+}
+
+// Renders logout forms for every realm, plus one form that logs out of all of them at once
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	realms := realmsFromCookies(r.Cookies(), time.Now())
+	// Cookies cleared by LogoutAll are gone without the gateway having logged anything out
+	cleared := r.URL.Query().Get("cleared") == "all"
+	loggedOut := ""
+	if !cleared {
+		loggedOut = loggedOutRealms(r, realms)
+	}
+
+	names := make([]string, 0, len(realms))
+	for _, realm := range realms {
+		names = append(names, realm.Name)
+	}
+	remember := &http.Cookie{Name: logoutRealmsCookie, Value: url.QueryEscape(strings.Join(names, ",")), Path: "/logout", HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	if len(names) == 0 {
+		remember.MaxAge = -1
+	}
+	http.SetCookie(w, remember)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	err := s.templates.ExecuteTemplate(w, "logout.html", map[string]interface{}{
+		"Realms":    realms,
+		"LoggedOut": loggedOut,
+		"Cleared":   cleared,
+	})
+	if err != nil {
+		log.Println("ERROR: Could not render logout page: ", err)
+	}
+}
+
+// Clears every realm's cookies without JS. The gateway logs out of one realm per request and only JS can post to it
+// for each realm in turn, so this merely expires the session and XSRF cookies of each realm whose XSRF token was
+// posted along, then sends the browser back to the page. The gateway sessions stay valid, as do cookies the gateway
+// set with another path or domain.
+func (s *Server) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	posted := make(map[string]bool)
+	for _, xsrf := range r.PostForm["_xsrf"] {
+		posted[xsrf] = true
+	}
+	for _, realm := range realmsFromCookies(r.Cookies(), time.Now()) {
+		// The XSRF cookie is only readable by pages on this host, so a matching token shows the page sent the form
+		if !posted[realm.XSRF] {
+			continue
+		}
+		for _, name := range []string{sessionCookiePrefix + realm.Name, xsrfCookiePrefix + realm.Name} {
+			http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+		}
+	}
+	http.Redirect(w, r, "/logout?cleared=all", http.StatusSeeOther)
+}
@@ -15,22 +15,24 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"syscall"
-	"text/template"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -41,12 +43,15 @@ import (
 	"github.com/openzipkin/zipkin-go/model"
 	reporterhttp "github.com/openzipkin/zipkin-go/reporter/http"
 	"github.com/plombardi89/gozeug/randomzeug"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
 )
 
 var port = 8080
 
-var authCount = 0
-
 const (
 	EnvPORT        = "PORT"
 	EnvHOST        = "HOST"
@@ -60,6 +65,41 @@ const (
 	EnvPodIP       = "POD_IP"       // The IP of this pod                                 #OPTIONAL - Consul Integration
 	EnvServiceName = "SERVICE_NAME" // The Name of the service (default: quote-consul)    #OPTIONAL - Consul Integration
 	EnvFilePath    = "FILE_PATH"    // The path where files will be stored				  #OPTIONAL - defaults to storing images in the container /images/ folder
+
+	EnvAuthCredentialsFile = "AUTH_CREDENTIALS_FILE" // JSON file with API keys and bcrypt password hashes  #OPTIONAL - Authentication
+	EnvAuthCredentials     = "AUTH_CREDENTIALS"      // The same JSON inline, used when no file is given     #OPTIONAL - Authentication
+	EnvAuthAPIKeyHeader    = "AUTH_APIKEY_HEADER"    // Header carrying an API key (default: X-API-Key)      #OPTIONAL - Authentication
+	EnvAuthAPIKeyParam     = "AUTH_APIKEY_PARAM"     // Query parameter carrying an API key (default: api_key) #OPTIONAL - Authentication
+	EnvRBACPolicyFile      = "RBAC_POLICY_FILE"      // JSON file mapping roles to permissions                #OPTIONAL - Authorization
+	EnvAuthDisabled        = "AUTH_DISABLED"         // Make anonymous callers admins in the built-in policy #OPTIONAL - defaults to false
+	EnvAuthScenariosFile   = "AUTH_SCENARIOS_FILE"   // JSON file with named /auth/* scenarios                #OPTIONAL - Auth testing
+	EnvAuthScenario        = "AUTH_SCENARIO"         // The default /auth/* scenario (default: alternate)    #OPTIONAL - Auth testing
+	EnvTLSClientCerts      = "TLS_CLIENT_CERTS"      // Ask TLS clients for certificates to echo in /debug/ #OPTIONAL - defaults to false
+	EnvDebugHistorySize    = "DEBUG_HISTORY_SIZE"    // Requests kept for /debug/history (default: 100)     #OPTIONAL - 0 disables the history
+	EnvDebugHistorySkip    = "DEBUG_HISTORY_SKIP"    // Comma separated paths left out of the history (default: /health) #OPTIONAL - empty records every path
+	EnvDebugReplayTarget   = "DEBUG_REPLAY_TARGET"   // Base URL /debug/replay/{id} sends requests to        #OPTIONAL - defaults to this server on loopback
+	EnvRedactionPolicyFile = "REDACTION_POLICY_FILE" // JSON file with what to hide in debug output and logs #OPTIONAL - defaults to credentials
+	EnvMaxBodySize         = "MAX_BODY_SIZE"         // Largest /debug/ and upload body in bytes (default: 32 MiB) #OPTIONAL - 0 disables the limit
+	EnvDebugBodyBuffer     = "DEBUG_BODY_BUFFER"     // Bytes of a body /debug/ echoes, the rest is hashed (default: 1 MiB) #OPTIONAL
+	EnvGRPCPort            = "GRPC_PORT"             // Port for a separate gRPC listener                    #OPTIONAL - defaults to sharing the HTTP port
+	EnvRPCCORSOrigins      = "RPC_CORS_ORIGINS"      // Comma separated origins allowed to call gRPC-Web and Connect routes #OPTIONAL - defaults to any origin
+	EnvTemplatesDir        = "TEMPLATES_DIR"         // The directory HTML templates are loaded from         #OPTIONAL - defaults to the templates built into the binary
+	EnvWSAllowedOrigins    = "WS_ALLOWED_ORIGINS"    // Comma separated origins allowed to open websockets    #OPTIONAL - defaults to any origin
+	EnvWSReadBufferSize    = "WS_READ_BUFFER_SIZE"   // Websocket read buffer in bytes (default: 1024)       #OPTIONAL
+	EnvWSWriteBufferSize   = "WS_WRITE_BUFFER_SIZE"  // Websocket write buffer in bytes (default: 1024)      #OPTIONAL
+	EnvWSMaxMessageSize    = "WS_MAX_MESSAGE_SIZE"   // Largest client message in bytes (default: 512)       #OPTIONAL
+	EnvWSWriteWait         = "WS_WRITE_WAIT"         // Time allowed to write a frame (default: 10s)         #OPTIONAL
+	EnvWSPongWait          = "WS_PONG_WAIT"          // Time allowed between pongs (default: 60s, min: 1s)  #OPTIONAL
+	EnvWSCompression       = "WS_COMPRESSION"        // Negotiate permessage-deflate (default: false)        #OPTIONAL
+	EnvWSCompressionLevel  = "WS_COMPRESSION_LEVEL"  // Deflate level from -2 to 9 (default: 1)             #OPTIONAL
+	EnvWSSendQueueSize     = "WS_SEND_QUEUE_SIZE"    // Frames buffered per stream client (default: 256, min: 130) #OPTIONAL
+	EnvWSOverflow          = "WS_OVERFLOW_POLICY"    // disconnect, drop-oldest, drop-newest or coalesce (default: disconnect) #OPTIONAL
+	EnvWSDrainTimeout      = "WS_DRAIN_TIMEOUT"      // Time allowed to flush clients on SIGTERM (default: 10s) #OPTIONAL
+	EnvWSReconnectAfter    = "WS_RECONNECT_AFTER"    // Reconnect hint sent to clients on SIGTERM            #OPTIONAL - no hint when unset
+	EnvWSMaxConnections    = "WS_MAX_CONNECTIONS"    // Open websockets allowed in total (default: 1024)      #OPTIONAL - 0 disables the limit
+	EnvWSMaxConnsPerIP     = "WS_MAX_CONNS_PER_IP"   // Open websockets allowed per client IP (default: 0)    #OPTIONAL - 0 disables the limit
+	EnvWSTrustedProxies    = "WS_TRUSTED_PROXIES"    // Comma separated proxy CIDRs whose X-Forwarded-For the per IP cap uses #OPTIONAL - defaults to none
+	EnvWSCookie            = "WS_COOKIE"             // Set-Cookie value sent when upgrading to a websocket   #OPTIONAL - defaults to quote-cookie=ws, empty sends none
 )
 
 type Server struct {
@@ -69,29 +109,72 @@ type Server struct {
 	tls      bool
 	router   *chi.Mux
 	upgrader websocket.Upgrader
+	wsOpts   *wsOptions
+	wsLimit  *connLimiter
 	hub      *Hub
 	random   *randomzeug.Random
 	quotes   []string
+	meta     map[string]QuoteMeta
 	reqTimes []time.Time
 	ready    bool
+	auth     *Authenticator
+	policy   *Policy
+
+	authTester *AuthTester
+	templates  *template.Template
+	history    *requestHistory
+	redactor   *redactor
+
+	// Base URL that recorded requests are replayed against
+	replayTarget string
+
+	// Largest body accepted by /debug/ and uploads, and how much of it /debug/ echoes. A zero body size disables the
+	// limit and a zero buffer echoes defaultDebugBodyBuffer bytes.
+	maxBodySize     int64
+	debugBodyBuffer int
+
+	// The gRPC services. They listen on grpcPort, or share the HTTP port when it is 0.
+	grpc       *grpc.Server
+	grpcHealth *health.Server
+	grpcPort   int
+
+	// Origins browsers may call the gRPC-Web and Connect routes from. "*" allows any origin.
+	corsOrigins []string
+
+	// Ask TLS clients for certificates so /debug/ can echo them
+	tlsClientCerts bool
 }
 
 type QuoteResult struct {
-	Server string    `json:"server"`
-	Quote  string    `json:"quote"`
-	Time   time.Time `json:"time"`
+	Server   string    `json:"server"`
+	Quote    string    `json:"quote"`
+	Time     time.Time `json:"time"`
+	Author   string    `json:"author,omitempty"`
+	Language string    `json:"language,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
 }
 
 type DebugInfo struct {
-	Server     string              `json:"server"`
-	Time       time.Time           `json:"time"`
-	Method     string              `json:"method"`
-	Host       string              `json:"host"`
-	Proto      string              `json:"proto"`
-	URL        *url.URL            `json:"url"`
-	RemoteAddr string              `json:"remoteaddr"`
-	Headers    map[string][]string `json:"headers`
-	Body       string              `json:"body`
+	Server        string              `json:"server"`
+	Time          time.Time           `json:"time"`
+	RequestID     string              `json:"request_id,omitempty"`
+	Method        string              `json:"method"`
+	Host          string              `json:"host"`
+	Proto         string              `json:"proto"`
+	URL           *url.URL            `json:"url"`
+	Query         map[string][]string `json:"query"`
+	RemoteAddr    string              `json:"remoteaddr"`
+	Headers       map[string][]string `json:"headers"`
+	Cookies       map[string]string   `json:"cookies"`
+	ContentLength int64               `json:"content_length"`
+	Body          string              `json:"body"`
+	BodySize      int64               `json:"body_size"`
+	BodySHA256    string              `json:"body_sha256"`
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+	Form          map[string][]string `json:"form,omitempty"`
+	Files         []DebugFile         `json:"files,omitempty"`
+	Trailers      map[string][]string `json:"trailers,omitempty"`
+	TLS           *DebugTLS           `json:"tls,omitempty"`
 }
 
 // Health check component of the ConsulPayload struct
@@ -113,89 +196,6 @@ type FileList struct {
 	FileList []string `json:"FileList"`
 }
 
-var tmpl = template.Must(template.
-	New("logout.html").
-	Funcs(template.FuncMap{
-		"trimprefix": strings.TrimPrefix,
-	}).
-	Parse(`<!DOCTYPE html>
-<html>
-	<head>
-		<meta charset="utf-8">
-		<title>Demo logout microservice</title>
-	</head>
-	<body>
-		<fieldset><legend>SSR</legend>
-			{{ if eq (len .RealmCookies) 0 }}
-				<p>Not logged in to any realms.</p>
-			{{ else }}
-				<ul>{{ range .RealmCookies }}
-					<li>
-						<form method="POST" action="/.ambassador/oauth2/logout" target="_blank">
-							<input type="hidden" name="realm" value="{{ trimprefix .Name "ambassador_xsrf." }}" />
-							<input type="hidden" name="_xsrf" value="{{ .Value }}" />
-							<input type="submit" value="log out of realm {{ trimprefix .Name "ambassador_xsrf." }}" />
-						</form>
-					</li>
-				{{ end }}</ul>
-			{{ end }}
-		</fieldset>
-		<fieldset><legend>JS</legend>
-			{{ .JSApp }}
-		</fieldset>
-	</body>
-</html>
-`))
-
-const jsApp = `<div id="app">
-	<ul>
-		<li v-for="(val, key) in realmCookies">
-			<form method="POST" action="/.ambassador/oauth2/logout" target="_blank">
-				<input type="hidden" name="realm" v-bind:value="key.slice('ambassador_xsrf.'.length)" />
-				<input type="hidden" name="_xsrf" v-bind:value="val" />
-				<input type="submit" v-bind:value="'log out of realm '+key.slice('ambassador_xsrf.'.length)" />
-			</form>
-		</li>
-	</ul>
-</div>
-<script type="module">
-	import Vue from 'https://cdn.jsdelivr.net/npm/vue/dist/vue.esm.browser.js';
-
-	function getCookies() {
-		let map = {};
-		let list = decodeURIComponent(document.cookie).split(';');
-		for (let i = 0; i < list.length; i++) {
-			let cookie = list[i].trimStart();
-			let eq = cookie.indexOf('=');
-			let key = cookie.slice(0, eq);
-			let val = cookie.slice(eq+1);
-			map[key] = val;
-		}
-		return map;
-	}
-
-	new Vue({
-		el: '#app',
-		data: function() {
-			return {
-				"cookies": getCookies(),
-			};
-		},
-		computed: {
-			"realmCookies": function() {
-				let ret = {};
-				for (let key in this.cookies) {
-					if (key.indexOf("ambassador_xsrf.") == 0) {
-						ret[key] = this.cookies[key];
-					}
-				}
-				return ret;
-			},
-		},
-	});
-</script>
-`
-
 func buildTracer(zipkinEndpoint string) (*zipkin.Tracer, error) {
 	reporter := reporterhttp.NewReporter(zipkinEndpoint)
 	localEndpoint := &model.Endpoint{ServiceName: "quote", Port: 8080}
@@ -326,11 +326,7 @@ func (s *Server) GetQuote(w http.ResponseWriter, r *http.Request) {
 
 	quote := s.random.RandomSelectionFromStringSlice(s.quotes)
 	//quote := "Service Preview Rocks!"
-	res := QuoteResult{
-		Server: s.id,
-		Quote:  quote,
-		Time:   time.Now().UTC(),
-	}
+	res := newQuoteResult(s.id, quote, s.meta)
 
 	resJson, err := json.MarshalIndent(res, "", "    ")
 	if err != nil {
@@ -348,19 +344,65 @@ func (s *Server) GetQuote(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) StreamQuotes(w http.ResponseWriter, r *http.Request) {
-	hdr := make(map[string][]string)
-	val := make([]string, 1)
-	val[0] = "quote-cookie=ws"
-	hdr["set-cookie"] = val
+	params, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	conn, err := s.upgrader.Upgrade(w, r, http.Header(hdr))
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "since must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	resume := r.URL.Query().Get("resume")
+	room := r.URL.Query().Get("room")
+	if room != "" && !roomNamePattern.MatchString(room) {
+		http.Error(w, "room must be 1 to 64 letters, digits, dashes or underscores", http.StatusBadRequest)
+		return
+	}
+
+	status, release := s.wsLimit.acquire(r)
+	if status != 0 {
+		log.Printf("ERROR: rejecting websocket from %s, connection limit reached\n", r.RemoteAddr)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	hdr := http.Header{}
+	if s.wsOpts.cookie != "" {
+		hdr.Set("Set-Cookie", s.wsOpts.cookie)
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, hdr)
 	if err != nil {
+		release()
 		log.Println(err)
 		return
 	}
+	if s.wsOpts.compression {
+		if err := conn.SetCompressionLevel(s.wsOpts.compressionLevel); err != nil {
+			log.Println(err)
+		}
+	}
 
-	client := &Client{hub: s.hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
+	client := newClient(s.hub, conn, params.interval).from(r, TransportWS)
+	client.opts = s.wsOpts
+	client.filter = params.filter
+	client.overflow = params.overflow
+	client.resumable = true
+	client.session = resume
+	client.resumeAfter = since
+	client.roomName = room
+	client.release = release
+	if !client.hub.enter(client) {
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(s.wsOpts.writeWait))
+		conn.Close()
+		release()
+		return
+	}
 
 	go client.readPump()
 	go client.writePump()
@@ -406,36 +448,51 @@ func (s *Server) Sleep(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (S *Server) TestAuth(w http.ResponseWriter, r *http.Request) {
-	if authCount > 0 {
-		w.WriteHeader(http.StatusOK)
-		authCount = 0
+func (s *Server) Debug(w http.ResponseWriter, r *http.Request) {
+	shape, err := parseEchoShape(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusInternalServerError)
-	authCount++
-}
 
-func (s *Server) Debug(w http.ResponseWriter, r *http.Request) {
-	var bBytes []byte
-	if r.Body != nil {
-		bBytes, _ = ioutil.ReadAll(r.Body)
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(bBytes))
+	if !s.limitBody(w, r) {
+		return
 	}
-
-	bString := string(bBytes)
+	body, err := readDebugBody(r, s.debugBodyBuffer)
+	if errors.Is(err, errBodyTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Println("ERROR: Could not read request body: ", err)
+		http.Error(w, "Could not read request body", http.StatusBadRequest)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body.data))
 
 	req := DebugInfo{
-		Server:     s.id,
-		Time:       time.Now().UTC(),
-		Method:     r.Method,
-		Host:       r.Host,
-		Proto:      r.Proto,
-		URL:        r.URL,
-		RemoteAddr: r.RemoteAddr,
-		Headers:    r.Header,
-		Body:       bString,
+		Server:        s.id,
+		Time:          time.Now().UTC(),
+		RequestID:     middleware.GetReqID(r.Context()),
+		Method:        r.Method,
+		Host:          r.Host,
+		Proto:         r.Proto,
+		URL:           r.URL,
+		Query:         r.URL.Query(),
+		RemoteAddr:    r.RemoteAddr,
+		Headers:       r.Header,
+		Cookies:       debugCookies(r),
+		ContentLength: r.ContentLength,
+		Body:          string(body.data),
+		BodySize:      body.size,
+		BodySHA256:    body.sha256,
+		BodyTruncated: body.truncated,
+		Trailers:      r.Trailer,
+		TLS:           debugTLS(r.TLS),
+	}
+	if !body.truncated {
+		req.Form, req.Files = debugForm(r)
 	}
+	req = s.redactor.debugInfo(req)
 
 	reqJson, err := json.MarshalIndent(req, "", "    ")
 	if err != nil {
@@ -446,34 +503,9 @@ func (s *Server) Debug(w http.ResponseWriter, r *http.Request) {
 
 	log.Println(string(reqJson))
 
-	if strings.Compare(r.URL.Path, "/add_header") == 0 {
-		w.Header().Set("x-custom-header", "true")
-		w.Header().Set("set-cookie", "quote-cookie=REST")
-	}
-
-	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
-
-	if _, err := w.Write(reqJson); err != nil {
-		log.Panicln(err)
-	}
-}
-
-func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
-	var realmCookies []*http.Cookie
-	for _, cookie := range r.Cookies() {
-		if strings.HasPrefix(cookie.Name, "ambassador_xsrf.") {
-			realmCookies = append(realmCookies, cookie)
-		}
+	if err := shape.write(r.Context(), w, reqJson); err != nil {
+		log.Println(err)
 	}
-	sort.Slice(realmCookies, func(i, j int) bool {
-		return realmCookies[i].Name < realmCookies[j].Name
-	})
-	w.Header().Set("Content-Type", "text/html; text/html; charset=utf-8")
-	tmpl.Execute(w, map[string]interface{}{
-		"RealmCookies": realmCookies,
-		"JSApp":        jsApp,
-	})
 }
 
 func GetFileContentType(out *os.File) (string, error) {
@@ -501,13 +533,22 @@ func (s *Server) Upload(w http.ResponseWriter, r *http.Request) {
 		envFilePath = "/images/"
 	}
 
+	if !s.limitBody(w, r) {
+		return
+	}
+	if err := r.ParseMultipartForm(formMaxMemory); errors.Is(err, errBodyTooLarge) {
+		log.Println("ERROR: Client upload too large: ", err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	io.WriteString(w, "Upload files\n")
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
 		log.Println("ERROR: Could not find file in client upload request: ", err)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Header().Set("Content-Type", "text/html; text/html; charset=utf-8")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write([]byte("Unable to read file from request"))
 		return
 	}
@@ -517,7 +558,7 @@ func (s *Server) Upload(w http.ResponseWriter, r *http.Request) {
 	if handler.Filename == "edgy.jpeg" {
 		log.Println("ERROR: Client tried to overwrite dummy file: ")
 		w.WriteHeader(http.StatusForbidden)
-		w.Header().Set("Content-Type", "text/html; text/html; charset=utf-8")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write([]byte("Sorry, you can't overwrite edgy.jpg"))
 		return
 	}
@@ -531,7 +572,7 @@ func (s *Server) Upload(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Println("ERROR: Could not write file from client: ", filePath)
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Header().Set("Content-Type", "text/html; text/html; charset=utf-8")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write([]byte("Error saving file to local storage"))
 		return
 	}
@@ -539,7 +580,7 @@ func (s *Server) Upload(w http.ResponseWriter, r *http.Request) {
 	io.Copy(f, file)
 	log.Println("SUCCESS, file uploaded to path: ", filePath)
 	w.WriteHeader(http.StatusOK)
-	w.Header().Set("Content-Type", "text/html; text/html; charset=utf-8")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Write([]byte("File uploaded successfully"))
 }
 
@@ -563,7 +604,7 @@ func (s *Server) Download(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Println("ERROR: Client requested file not found: ", filePath)
 		w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "text/html; text/html; charset=utf-8")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write([]byte("Could not find file locally"))
 		return
 	}
@@ -593,6 +634,42 @@ func (s *Server) Download(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (s *Server) DeleteFile(w http.ResponseWriter, r *http.Request) {
+
+	envFilePath := os.Getenv(EnvFilePath)
+	if envFilePath == "" {
+		envFilePath = "/images/"
+	}
+
+	fileName := path.Base(r.URL.Path)
+	filePath := fmt.Sprintf("%s%s", envFilePath, fileName)
+
+	// Cant delete edgy.jpg either
+	if fileName == "edgy.jpeg" {
+		log.Println("ERROR: Client tried to delete dummy file")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Sorry, you can't delete edgy.jpg"))
+		return
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		log.Println("ERROR: Could not delete file: ", filePath, err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Could not find file locally"))
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error deleting file from local storage"))
+		}
+		return
+	}
+
+	log.Println("SUCCESS, file deleted from path: ", filePath)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) ListFiles(w http.ResponseWriter, r *http.Request) {
 	log.Println("Listing Files...")
 
@@ -666,31 +743,56 @@ func (s *Server) ConfigureRouter() {
 					tracer,
 					zipkinhttp.SpanName("quote_request_span")),
 			)
+			s.router.Use(s.redactor.span)
 		}
 	}
 
 	s.router.Use(middleware.Recoverer)
 	s.router.Use(middleware.RequestID)
+	s.router.Use(rememberPeer)
 	s.router.Use(middleware.RealIP)
-
-	s.router.Get("/", s.GetQuote)
-	s.router.Head("/", s.GetQuote)
-	s.router.Get("/get-quote/", s.GetQuote)
-	s.router.HandleFunc("/ws", s.StreamQuotes)
-	s.router.Delete("/debug/", s.Debug)
-	s.router.Post("/debug/", s.Debug)
-	s.router.Put("/debug/", s.Debug)
+	s.router.Use(s.history.record)
+
+	s.router.With(s.authorize(PermQuotesRead)).Get("/", s.GetQuote)
+	s.router.With(s.authorize(PermQuotesRead)).Head("/", s.GetQuote)
+	s.router.With(s.authorize(PermQuotesRead)).Get("/get-quote/", s.GetQuote)
+	s.router.With(s.authorize(PermQuotesRead)).HandleFunc("/ws", s.StreamQuotes)
+	s.router.With(s.authorize(PermQuotesRead)).Get("/sse", s.StreamEvents)
+	s.router.With(s.authorize(PermQuotesRead)).Get("/stream", s.StreamNDJSON)
+	s.router.With(s.authorize(PermQuotesRead)).Get("/poll", s.PollQuotes)
+	s.router.With(s.authorize(PermQuotesRead)).Get("/rooms", s.ListRooms)
+	s.router.With(s.authorize(PermAdminConfig)).Get("/ws/clients", s.ListClients)
+	s.router.With(s.authorize(PermAdminConfig)).Get("/ws/stats", s.GetHubStats)
+	s.router.With(s.authorize(PermAdminConfig)).Get("/debug/history", s.GetHistory)
+	s.router.With(s.authorize(PermAdminConfig)).Get("/debug/history/ui", s.HistoryPage)
+	s.router.With(s.authorize(PermAdminConfig)).Get("/debug/history.har", s.GetHistoryHAR)
+	s.router.With(s.authorize(PermAdminConfig)).Post("/debug/replay/{id}", s.Replay)
+	s.router.Delete("/debug/*", s.Debug)
+	s.router.Post("/debug/*", s.Debug)
+	s.router.Put("/debug/*", s.Debug)
 	s.router.Get("/debug/*", s.Debug)
 	s.router.Options("/debug/*", s.Debug)
+	s.router.With(s.rpcCORS, s.authorize(PermQuotesRead)).HandleFunc("/qotm.v1.QuoteService/{method}", s.ServeRPC)
+	s.router.With(s.rpcCORS).HandleFunc("/qotm.v1.EchoService/{method}", s.ServeRPC)
 	s.router.Post("/health", s.HealthCheck)
 	s.router.Get("/health", s.HealthCheck)
 	s.router.Get("/auth/*", s.TestAuth)
 	s.router.Get("/logout", s.Logout)
+	s.router.Post("/logout", s.LogoutAll)
+
+	static, err := staticHandler()
+	if err != nil {
+		log.Fatalln("Could not load static assets: ", err)
+	}
+	s.router.Handle("/static/*", http.StripPrefix("/static", static))
 	s.router.Get("/sleep/*", s.Sleep)
+	s.router.Get("/whoami", s.WhoAmI)
+	s.router.With(s.authorize(PermAdminConfig)).Get("/admin/policy", s.GetPolicy)
+	s.router.With(s.authorize(PermWSBroadcast)).Post("/broadcast", s.Broadcast)
 
 	// These two endpoints can be enabled without a volume claim since we will serve a image that ships with the container
-	s.router.Get("/files/", s.ListFiles)
-	s.router.Get("/files/*", s.Download)
+	s.router.With(s.authorize(PermFilesRead)).Get("/files/", s.ListFiles)
+	s.router.With(s.authorize(PermFilesRead)).Get("/files/*", s.Download)
 
 	envFilePath := os.Getenv(EnvFilePath)
 	if envFilePath == "" {
@@ -704,8 +806,13 @@ func (s *Server) ConfigureRouter() {
 		log.Println("Found storage directory: ", defaultFolder)
 		log.Println("enabling file upload endpoints")
 
-		s.router.Put("/files/*", s.Upload)
-		s.router.Post("/files/*", s.Upload)
+		if !s.auth.Enabled() {
+			log.Println("No credentials configured, file uploads and deletes need AUTH_CREDENTIALS or AUTH_DISABLED")
+		}
+
+		s.router.With(s.authorize(PermFilesWrite)).Put("/files/*", s.Upload)
+		s.router.With(s.authorize(PermFilesWrite)).Post("/files/*", s.Upload)
+		s.router.With(s.authorize(PermFilesDelete)).Delete("/files/*", s.DeleteFile)
 	} else {
 		log.Println("Default directory not detected, disabling file upload endpoints")
 	}
@@ -714,15 +821,61 @@ func (s *Server) ConfigureRouter() {
 }
 
 func (s *Server) Start() error {
-	s.hub = newHub(s.random, s.quotes, s.id)
+	s.hub = newHub(s.random, s.quotes, s.meta, s.id)
+	s.hub.queueSize = s.wsOpts.sendQueueSize
+	s.hub.policy = s.wsOpts.overflow
 	go s.hub.run()
 
+	var handler http.Handler = s.router
+	if s.grpcPort != 0 {
+		if err := s.serveGRPC(); err != nil {
+			return err
+		}
+	} else {
+		s.grpc, s.grpcHealth = s.newGRPCServer()
+		handler = s.grpcMux(handler)
+		log.Println("serving gRPC on the HTTP port")
+	}
+
 	listenAddr := fmt.Sprintf("%s:%d", s.host, s.port)
 	log.Printf("listening on %s\n", listenAddr)
 	if s.tls {
-		return http.ListenAndServeTLS(listenAddr, "/certs/cert.pem", "/certs/key.pem", s.router)
+		srv := &http.Server{Addr: listenAddr, Handler: handler}
+		if s.tlsClientCerts {
+			// Only asked for so /debug/ can echo them, never verified
+			srv.TLSConfig = &tls.Config{ClientAuth: tls.RequestClientCert}
+		}
+		return srv.ListenAndServeTLS("/certs/cert.pem", "/certs/key.pem")
 	}
-	return http.ListenAndServe(listenAddr, s.router)
+	if s.grpcPort == 0 {
+		// gRPC clients speak HTTP/2 without TLS
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return http.ListenAndServe(listenAddr, handler)
+}
+
+// Starts the gRPC services on their own port, with the HTTP certificate when TLS is enabled
+func (s *Server) serveGRPC() error {
+	var opts []grpc.ServerOption
+	if s.tls {
+		creds, err := credentials.NewServerTLSFromFile("/certs/cert.pem", "/certs/key.pem")
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s.grpc, s.grpcHealth = s.newGRPCServer(opts...)
+
+	listenAddr := fmt.Sprintf("%s:%d", s.host, s.grpcPort)
+	lis, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving gRPC on %s\n", listenAddr)
+	go func() {
+		log.Fatalln(s.grpc.Serve(lis))
+	}()
+	return nil
 }
 
 func main() {
@@ -730,6 +883,10 @@ func main() {
 	if err != nil {
 		log.Println("ERROR: ENABLE_HTTPS environment variable must be either 'true' or 'false'.")
 	}
+	tlsClientCerts, err := strconv.ParseBool(getEnv(EnvTLSClientCerts, "false"))
+	if err != nil {
+		log.Println("ERROR: TLS_CLIENT_CERTS environment variable must be either 'true' or 'false'.")
+	}
 	defPort := "8080"
 	if tls {
 		defPort = "8443"
@@ -756,23 +913,127 @@ func main() {
 		"668: The Neighbor of the Beast.",
 	}
 
+	// Used by stream subscriptions to filter quotes
+	startingQuoteMeta := map[string]QuoteMeta{
+		"Abstraction is ever present.":                      {Author: "Anonymous", Language: "en", Tags: []string{"philosophy"}},
+		"A late night does not make any sense.":             {Author: "Anonymous", Language: "en", Tags: []string{"humor"}},
+		"A principal idea is omnipresent, much like candy.": {Author: "Anonymous", Language: "en", Tags: []string{"philosophy", "humor"}},
+		"Nihilism gambles with lives, happiness, and even destiny itself!": {
+			Author: "Anonymous", Language: "en", Tags: []string{"philosophy"},
+		},
+		"The light at the end of the tunnel is interdependent on the relatedness of motivation, subcultures, and management.": {
+			Author: "Anonymous", Language: "en", Tags: []string{"management"},
+		},
+		"Utter nonsense is a storyteller without equal.":                 {Author: "Anonymous", Language: "en", Tags: []string{"nonsense"}},
+		"Non-locality is the driver of truth. By summoning, we vibrate.": {Author: "Anonymous", Language: "en", Tags: []string{"science"}},
+		"A small mercy is nothing at all?":                               {Author: "Anonymous", Language: "en", Tags: []string{"philosophy"}},
+		"The last sentence you read is often sensible nonsense.":         {Author: "Anonymous", Language: "en", Tags: []string{"nonsense"}},
+		"668: The Neighbor of the Beast.":                                {Author: "Anonymous", Language: "en", Tags: []string{"humor"}},
+	}
+
+	creds, err := loadCredentials()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	auth, err := newAuthenticator(creds, getEnv(EnvAuthAPIKeyHeader, "X-API-Key"), getEnv(EnvAuthAPIKeyParam, "api_key"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	authDisabled, err := strconv.ParseBool(getEnv(EnvAuthDisabled, "false"))
+	if err != nil {
+		log.Fatalln("AUTH_DISABLED must be true or false")
+	}
+	if authDisabled {
+		log.Println("WARNING: AUTH_DISABLED is set, anonymous callers can upload, delete files and use admin endpoints")
+	}
+	policy, err := loadPolicy(authDisabled)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	scenarios, err := loadAuthScenarios()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	templates, err := loadTemplates(os.Getenv(EnvTemplatesDir))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	wsOpts, err := loadWSOptions()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	redactor, err := loadRedactionPolicy(getEnv(EnvAuthAPIKeyHeader, "X-API-Key"), getEnv(EnvAuthAPIKeyParam, "api_key"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	maxBodySize, err := strconv.ParseInt(getEnv(EnvMaxBodySize, strconv.Itoa(defaultMaxBodySize)), 10, 64)
+	if err != nil || maxBodySize < 0 {
+		log.Fatalln("MAX_BODY_SIZE must be a positive number of bytes")
+	}
+	debugBodyBuffer, err := strconv.Atoi(getEnv(EnvDebugBodyBuffer, strconv.Itoa(defaultDebugBodyBuffer)))
+	if err != nil || debugBodyBuffer <= 0 {
+		log.Fatalln("DEBUG_BODY_BUFFER must be a positive number of bytes")
+	}
+	grpcPort, err := strconv.Atoi(getEnv(EnvGRPCPort, "0"))
+	if err != nil || grpcPort < 0 || grpcPort > 65535 || (grpcPort != 0 && grpcPort == port) {
+		log.Fatalln("GRPC_PORT must be in range 1..65535 (inclusive) and differ from PORT")
+	}
+	historySize, err := strconv.Atoi(getEnv(EnvDebugHistorySize, strconv.Itoa(defaultHistorySize)))
+	if err != nil || historySize < 0 {
+		log.Fatalln("DEBUG_HISTORY_SIZE must be a positive number")
+	}
+	historySkip := []string{defaultHistorySkip}
+	if v, ok := os.LookupEnv(EnvDebugHistorySkip); ok {
+		historySkip = nil
+		for _, path := range strings.Split(v, ",") {
+			if path = strings.TrimSpace(path); path != "" {
+				historySkip = append(historySkip, path)
+			}
+		}
+	}
+	var corsOrigins []string
+	for _, origin := range strings.Split(getEnv(EnvRPCCORSOrigins, "*"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	replayScheme, replayHost := "http", getEnv(EnvHOST, "127.0.0.1")
+	if tls {
+		replayScheme = "https"
+	}
+	replayTarget := getEnv(EnvDebugReplayTarget, fmt.Sprintf("%s://%s:%d", replayScheme, replayHost, port))
+
 	random := randomzeug.NewRandom()
 	s := Server{
-		id:     generateServerID(random),
-		host:   os.Getenv(EnvHOST),
-		port:   port,
-		tls:    tls,
-		router: chi.NewRouter(),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-		},
-		random: random,
-		quotes: startingQuotes,
-		ready:  true,
+		id:       generateServerID(random),
+		host:     os.Getenv(EnvHOST),
+		port:     port,
+		tls:      tls,
+		router:   chi.NewRouter(),
+		upgrader: wsOpts.upgrader(),
+		wsOpts:   wsOpts,
+		wsLimit:  newConnLimiter(wsOpts.maxConns, wsOpts.maxConnsPerIP, wsOpts.trustedProxies),
+		random:   random,
+		quotes:   startingQuotes,
+		meta:     startingQuoteMeta,
+		ready:    true,
+		auth:     auth,
+		policy:   policy,
+
+		templates:  templates,
+		authTester: newAuthTester(scenarios),
+		history:    newRequestHistory(historySize, historySkip),
+		redactor:   redactor,
+
+		tlsClientCerts: tlsClientCerts,
+		replayTarget:   replayTarget,
+
+		maxBodySize:     maxBodySize,
+		debugBodyBuffer: debugBodyBuffer,
+
+		grpcPort:    grpcPort,
+		corsOrigins: corsOrigins,
 	}
 
 	// Check for Consul integration & register the service with Consul
@@ -787,7 +1048,8 @@ func main() {
 	go func(r *bool) {
 		<-signals
 		*r = false
-		fmt.Printf("SIGTERM received. Marked unhealthy and waiting to be killed.\n")
+		fmt.Printf("SIGTERM received. Marked unhealthy, draining stream clients and waiting to be killed.\n")
+		s.drain()
 	}(&s.ready)
 
 	log.Fatalln(s.Start())
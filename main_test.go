@@ -14,11 +14,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"github.com/plombardi89/gozeug/randomzeug"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestServer_GetQuote(t *testing.T) {
@@ -59,3 +69,438 @@ func TestServer_GetOpenAPIDocument(t *testing.T) {
 	assert.Equal(t, "application/json", rr.Header().Get("content-type"))
 	assert.Equal(t, openapiDocument, rr.Body.String())
 }
+
+func TestServer_Logout(t *testing.T) {
+	templates, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/logout?logged_out=b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"sub":"alice","exp":4102444800}
+	req.AddCookie(&http.Cookie{Name: "ambassador_session.a", Value: "e30.eyJzdWIiOiJhbGljZSIsImV4cCI6NDEwMjQ0NDgwMH0.sig"})
+	req.AddCookie(&http.Cookie{Name: "ambassador_xsrf.a", Value: "xsrf-a"})
+
+	s := Server{templates: templates}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(s.Logout)
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, contentSecurityPolicy, rr.Header().Get("Content-Security-Policy"))
+	assert.Contains(t, rr.Body.String(), `value="xsrf-a"`)
+	assert.Contains(t, rr.Body.String(), "<td>alice</td>")
+	assert.Contains(t, rr.Body.String(), "expires at 2100-01-01 00:00:00 UTC")
+	assert.Contains(t, rr.Body.String(), "Logged out of realm b.")
+}
+
+func TestServer_LogoutAll(t *testing.T) {
+	templates, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{templates: templates}
+	cookies := []*http.Cookie{
+		{Name: "ambassador_xsrf.a", Value: "xsrf-a"},
+		{Name: "ambassador_session.a", Value: "session-a"},
+		{Name: "ambassador_xsrf.b", Value: "xsrf-b"},
+	}
+
+	// The page renders a form for all realms without JS
+	req := httptest.NewRequest("GET", "/logout", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.Logout).ServeHTTP(rr, req)
+	assert.Contains(t, rr.Body.String(), `<form id="logout-all" method="POST" action="/logout">`)
+	assert.Contains(t, rr.Body.String(), `value="log out of all realms"`)
+	remembered := rr.Result().Cookies()[0]
+	assert.Equal(t, logoutRealmsCookie, remembered.Name)
+
+	// Only realms whose token was posted are logged out
+	req = httptest.NewRequest("POST", "/logout", strings.NewReader("_xsrf=xsrf-a&_xsrf=wrong"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.LogoutAll).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusSeeOther, rr.Code)
+	assert.Equal(t, "/logout?cleared=all", rr.Header().Get("Location"))
+	var expired []string
+	for _, c := range rr.Result().Cookies() {
+		assert.True(t, c.MaxAge < 0)
+		expired = append(expired, c.Name)
+	}
+	assert.Equal(t, []string{"ambassador_session.a", "ambassador_xsrf.a"}, expired)
+
+	// The page does not claim the gateway sessions were revoked
+	req = httptest.NewRequest("GET", "/logout?cleared=all", nil)
+	req.AddCookie(remembered)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.Logout).ServeHTTP(rr, req)
+	assert.Contains(t, rr.Body.String(), "The gateway sessions were not revoked")
+	assert.NotContains(t, rr.Body.String(), "Logged out of")
+
+	// The gateway redirected back without ?logged_out=, realm a is gone
+	req = httptest.NewRequest("GET", "/logout", nil)
+	req.AddCookie(cookies[2])
+	req.AddCookie(remembered)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(s.Logout).ServeHTTP(rr, req)
+	assert.Contains(t, rr.Body.String(), "Logged out of realm a.")
+	assert.NotContains(t, rr.Body.String(), `value="log out of all realms"`)
+}
+
+func TestStaticHandler(t *testing.T) {
+	handler, err := staticHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/logout.js", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Type"), "javascript")
+	assert.Equal(t, "public, max-age=3600", rr.Header().Get("Cache-Control"))
+
+	req := httptest.NewRequest("GET", "/logout.js", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestServer_Debug(t *testing.T) {
+	s := Server{id: "test-server"}
+	ts := httptest.NewTLSServer(middleware.RequestID(http.HandlerFunc(s.Debug)))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL+"/debug/?color=red&color=blue", strings.NewReader("quote=hello&author=alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "flavor", Value: "mint"})
+
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	info := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&info))
+
+	assert.Contains(t, info, "headers")
+	assert.Equal(t, "quote=hello&author=alice", info["body"])
+	assert.Equal(t, float64(24), info["content_length"])
+	assert.NotEmpty(t, info["request_id"])
+	assert.Equal(t, map[string]interface{}{"color": []interface{}{"red", "blue"}}, info["query"])
+	assert.Equal(t, map[string]interface{}{"flavor": "mint"}, info["cookies"])
+	assert.Equal(t, map[string]interface{}{"quote": []interface{}{"hello"}, "author": []interface{}{"alice"}}, info["form"])
+	if tls, ok := info["tls"].(map[string]interface{}); assert.True(t, ok) {
+		assert.Contains(t, tls["version"], "TLS 1.")
+		assert.NotEmpty(t, tls["cipher_suite"])
+	}
+}
+
+func TestServer_DebugShaping(t *testing.T) {
+	s := Server{id: "test-server"}
+	ts := httptest.NewServer(http.HandlerFunc(s.Debug))
+	defer ts.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	res, err := client.Get(ts.URL + "/debug/gateway?status=503&header=X-Custom:%20true&size=10&fill=ab&content_type=text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get("X-Custom"))
+	assert.Equal(t, "text/plain", res.Header.Get("Content-Type"))
+	assert.Equal(t, "ababababab", string(body))
+
+	req, _ := http.NewRequest("GET", ts.URL+"/debug/", nil)
+	req.Header.Set("X-Echo-Size", "3000")
+	req.Header.Set("X-Echo-Chunk-Delay-Ms", "20")
+	start := time.Now()
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Len(t, body, 3000)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.True(t, time.Since(start) >= 40*time.Millisecond)
+
+	res, err = client.Get(ts.URL + "/debug/?redirect=/debug/elsewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "/debug/elsewhere", res.Header.Get("Location"))
+
+	res, err = client.Get(ts.URL + "/debug/?delay_ms=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestServer_History(t *testing.T) {
+	templates, err := loadTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{id: "test-server", templates: templates, history: newRequestHistory(2, []string{"/health"})}
+	router := chi.NewRouter()
+	router.Use(s.history.record)
+	router.Get("/debug/history", s.GetHistory)
+	router.Get("/debug/history/ui", s.HistoryPage)
+	router.Get("/debug/*", s.Debug)
+	router.Post("/debug/*", s.Debug)
+
+	send := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	list := func(query string) []HistoryEntry {
+		var entries []HistoryEntry
+		assert.NoError(t, json.Unmarshal(send("GET", "/debug/history"+query, "", nil).Body.Bytes(), &entries))
+		return entries
+	}
+
+	send("GET", "/debug/first", "", nil)
+	send("POST", "/debug/second?status=201", "hello", http.Header{"X-Trace": {"abc123"}})
+	send("GET", "/debug/third", "", http.Header{"X-Trace": {"def456"}})
+	send("GET", "/health", "", nil)
+
+	entries := list("")
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "/debug/third", entries[0].Path)
+		assert.Equal(t, uint64(3), entries[0].ID)
+		assert.Equal(t, "/debug/*", entries[0].Route)
+		assert.Equal(t, "POST", entries[1].Method)
+		assert.Equal(t, "hello", entries[1].Body)
+		assert.Equal(t, http.StatusCreated, entries[1].Status)
+		assert.Equal(t, []string{"application/json"}, entries[1].ResponseHeaders["Content-Type"])
+		assert.NotZero(t, entries[1].ResponseSize)
+	}
+
+	assert.Len(t, list("?method=post"), 1)
+	assert.Len(t, list("?path=/debug/th"), 1)
+	assert.Len(t, list("?header=X-Trace"), 2)
+	if entries := list("?header=X-Trace:%20abc"); assert.Len(t, entries, 1) {
+		assert.Equal(t, "/debug/second", entries[0].Path)
+	}
+	assert.Len(t, list("?limit=1"), 1)
+
+	rr := send("GET", "/debug/history/ui?refresh=2", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `<meta http-equiv="refresh" content="2">`)
+	assert.Contains(t, rr.Body.String(), "/debug/third")
+}
+
+func TestHAREntry_Binary(t *testing.T) {
+	entry := harEntry(&HistoryEntry{
+		Method:       "POST",
+		URL:          "/debug/upload",
+		Headers:      map[string][]string{"Content-Type": {"application/octet-stream"}},
+		Body:         "\xff\xfe\x00\x01",
+		Status:       http.StatusOK,
+		ResponseBody: `{"ok": true}`,
+	})
+	assert.Equal(t, &HARPostData{MimeType: "application/octet-stream", Text: "//4AAQ==", Comment: "encoding: base64"}, entry.Request.PostData)
+	assert.Equal(t, `{"ok": true}`, entry.Response.Content.Text)
+	assert.Empty(t, entry.Response.Content.Encoding)
+}
+
+func TestReplay_LargeResponse(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			// Never ends on its own
+			for r.Context().Err() == nil {
+				if _, err := w.Write(bytes.Repeat([]byte("a"), 1024)); err != nil {
+					return
+				}
+			}
+			return
+		}
+		w.Write(bytes.Repeat([]byte("a"), 200<<10))
+	}))
+	defer target.Close()
+
+	for _, path := range []string{"/big", "/stream"} {
+		res, err := replay(target.URL, &HistoryEntry{Method: "GET", URL: path})
+		if assert.NoError(t, err, path) {
+			assert.Len(t, res.Body, historyMaxBody, path)
+			assert.True(t, res.BodyTruncated, path)
+		}
+	}
+}
+
+func TestServer_HistoryHARAndReplay(t *testing.T) {
+	s := &Server{id: "test-server", history: newRequestHistory(10, nil)}
+	router := chi.NewRouter()
+	router.Use(s.history.record)
+	router.Get("/debug/history", s.GetHistory)
+	router.Get("/debug/history.har", s.GetHistoryHAR)
+	router.Post("/debug/replay/{id}", s.Replay)
+	router.Post("/debug/*", s.Debug)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	s.replayTarget = ts.URL
+
+	req, _ := http.NewRequest("POST", ts.URL+"/debug/route?status=201&color=red", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	req.AddCookie(&http.Cookie{Name: "flavor", Value: "mint"})
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	res, err = http.Get(ts.URL + "/debug/history.har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har HAR
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&har))
+	res.Body.Close()
+	assert.Equal(t, "1.2", har.Log.Version)
+	if assert.Len(t, har.Log.Entries, 1) {
+		entry := har.Log.Entries[0]
+		assert.Equal(t, ts.URL+"/debug/route?status=201&color=red", entry.Request.URL)
+		assert.Contains(t, entry.Request.QueryString, HARNameValue{Name: "color", Value: "red"})
+		assert.Equal(t, []HARCookie{{Name: "flavor", Value: "mint"}}, entry.Request.Cookies)
+		assert.Equal(t, &HARPostData{MimeType: "text/plain", Text: "hello"}, entry.Request.PostData)
+		assert.Equal(t, http.StatusCreated, entry.Response.Status)
+		assert.Equal(t, "application/json", entry.Response.Content.MimeType)
+		assert.Contains(t, entry.Response.Content.Text, `"body": "hello"`)
+	}
+
+	res, err = http.Post(ts.URL+"/debug/replay/1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result ReplayResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, http.StatusCreated, result.Replayed.Status)
+	assert.False(t, result.StatusChanged)
+	assert.Contains(t, result.Replayed.Body, `"body": "hello"`)
+	// The echo carries the time, which differs between the two
+	assert.Contains(t, result.BodyDiff, `-     "time"`)
+	assert.Contains(t, result.BodyDiff, `+     "time"`)
+
+	var entries []HistoryEntry
+	res, err = http.Get(ts.URL + "/debug/history?header=" + replayHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&entries))
+	res.Body.Close()
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{"1"}, entries[0].Headers[replayHeader])
+	}
+
+	res, err = http.Post(ts.URL+"/debug/replay/42", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Equal(t, "", diffLines("a\nb", "a\nb"))
+	assert.Equal(t, "  a\n- b\n+ c\n  d\n", diffLines("a\nb\nd", "a\nc\nd"))
+}
+
+// A body that hands its content to io.Copy through WriteTo, as a bare strings.Reader does
+type writerToBody struct {
+	*strings.Reader
+}
+
+func (writerToBody) Close() error { return nil }
+
+func TestReadDebugBody_WriterTo(t *testing.T) {
+	req := httptest.NewRequest("POST", "/debug/", nil)
+	req.Body = writerToBody{strings.NewReader(strings.Repeat("a", 50))}
+
+	body, err := readDebugBody(req, 10)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte(strings.Repeat("a", 10)), body.data)
+		assert.Equal(t, int64(50), body.size)
+		assert.True(t, body.truncated)
+	}
+}
+
+func TestServer_BodyLimits(t *testing.T) {
+	s := Server{id: "test-server", maxBodySize: 100, debugBodyBuffer: 10}
+	ts := httptest.NewServer(http.HandlerFunc(s.Debug))
+	defer ts.Close()
+
+	body := strings.Repeat("a", 50)
+	res, err := http.Post(ts.URL+"/debug/", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info DebugInfo
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&info))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, strings.Repeat("a", 10), info.Body)
+	assert.True(t, info.BodyTruncated)
+	assert.Equal(t, int64(50), info.BodySize)
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte(body))), info.BodySHA256)
+
+	res, err = http.Post(ts.URL+"/debug/", "text/plain", strings.NewReader(strings.Repeat("a", 101)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	// Without a length the limit is only hit while reading
+	res, err = http.Post(ts.URL+"/debug/", "text/plain", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 101))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	part, _ := form.CreateFormFile("file", "big.txt")
+	part.Write([]byte(strings.Repeat("a", 200)))
+	form.Close()
+	req := httptest.NewRequest("POST", "/files/", ioutil.NopCloser(&upload))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rr := httptest.NewRecorder()
+	s.Upload(rr, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+}
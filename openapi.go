@@ -54,9 +54,122 @@ var openapiDocument = `
 				}
 			}
 		},
+		"/qotm.v1.QuoteService/GetQuote": {
+			"post": {
+				"summary": "Return a randomly selected quote over gRPC-Web or Connect.",
+				"description": "REST equivalent: GET /. Accepts Connect unary calls (application/json, application/proto) and gRPC-Web (application/grpc-web[-text][+proto|+json]). Native gRPC clients call the same method on GRPC_PORT or the HTTP port.",
+				"x-rest-equivalent": {"method": "GET", "path": "/"},
+				"requestBody": {
+					"content": {
+						"application/json": {"schema": {"type": "object"}}
+					}
+				},
+				"responses": {
+					"200": {
+						"description": "The qotm.v1.Quote message.",
+						"content": {
+							"application/json": {
+								"schema": {
+									"type": "object",
+									"properties": {
+										"server": {"type": "string"},
+										"quote": {"type": "string"},
+										"time": {"type": "string", "format": "date-time"},
+										"author": {"type": "string"},
+										"language": {"type": "string"},
+										"tags": {"type": "array", "items": {"type": "string"}},
+										"seq": {"type": "string", "description": "Sequence number of a streamed quote, a string as it is 64 bits"},
+										"room": {"type": "string", "description": "Room a streamed quote was sent to"}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		},
+		"/qotm.v1.QuoteService/StreamQuotes": {
+			"post": {
+				"summary": "Stream quotes over gRPC-Web or the Connect streaming protocol.",
+				"description": "REST equivalents: GET /sse, GET /stream and the /ws websocket, with interval_ms and room as query parameters. The request is a single length prefixed qotm.v1.StreamQuotesRequest; the response is a stream of length prefixed qotm.v1.Quote messages.",
+				"x-rest-equivalent": {"method": "GET", "path": "/stream"},
+				"requestBody": {
+					"content": {
+						"application/connect+json": {
+							"schema": {
+								"type": "object",
+								"properties": {
+									"filter": {"type": "object", "properties": {"tags": {"type": "array", "items": {"type": "string"}}, "author": {"type": "string"}, "language": {"type": "string"}}},
+									"intervalMs": {"type": "integer", "minimum": 100, "maximum": 3600000},
+									"room": {"type": "string"}
+								}
+							}
+						}
+					}
+				},
+				"responses": {
+					"200": {"description": "A stream of quotes ended by a frame with the status."}
+				}
+			}
+		},
+		"/qotm.v1.QuoteService/Chat": {
+			"post": {
+				"summary": "Chat with everyone in a room over the Connect streaming protocol.",
+				"description": "REST equivalent: the say message of the /ws websocket. Both sides stream, so this needs HTTP/2 and is not available to gRPC-Web clients. The first qotm.v1.ChatMessage names the room.",
+				"x-rest-equivalent": {"method": "GET", "path": "/ws"},
+				"responses": {
+					"200": {"description": "A stream of chat messages from the room."}
+				}
+			}
+		},
+		"/qotm.v1.EchoService/Echo": {
+			"post": {
+				"summary": "Return the call's metadata over gRPC-Web or Connect.",
+				"description": "REST equivalent: POST /debug/. Metadata is redacted with the redaction policy like the debug echo.",
+				"x-rest-equivalent": {"method": "POST", "path": "/debug/"},
+				"requestBody": {
+					"content": {
+						"application/json": {"schema": {"type": "object", "properties": {"body": {"type": "string", "format": "byte"}}}}
+					}
+				},
+				"responses": {
+					"200": {
+						"description": "The qotm.v1.EchoResponse message.",
+						"content": {
+							"application/json": {
+								"schema": {
+									"type": "object",
+									"properties": {
+										"server": {"type": "string"},
+										"time": {"type": "string", "format": "date-time"},
+										"method": {"type": "string"},
+										"authority": {"type": "string"},
+										"peer": {"type": "string"},
+										"metadata": {"type": "object", "additionalProperties": {"type": "object", "properties": {"values": {"type": "array", "items": {"type": "string"}}}}},
+										"body": {"type": "string", "format": "byte"},
+										"tls": {"type": "object"}
+									}
+								}
+							}
+						}
+					}
+				}
+			}
+		},
 		"/debug/": {
 			"get": {
 				"summary": "Return debug information about the request.",
+				"description": "Every parameter below can also be sent as the matching X-Echo-* header, e.g. X-Echo-Chunk-Delay-Ms. The query parameter wins when both are set.",
+				"parameters": [
+					{"name": "status", "in": "query", "description": "Status code of the response", "schema": {"type": "integer", "minimum": 200, "maximum": 599, "default": 200}},
+					{"name": "header", "in": "query", "description": "Extra response header in the form 'Name: value'. Can be repeated.", "schema": {"type": "array", "items": {"type": "string"}}},
+					{"name": "size", "in": "query", "description": "Send this many generated bytes instead of the JSON echo", "schema": {"type": "integer", "minimum": 0, "maximum": 10485760}},
+					{"name": "fill", "in": "query", "description": "Bytes to repeat in a generated body, or 'random'", "schema": {"type": "string", "default": "random"}},
+					{"name": "content_type", "in": "query", "description": "Content-Type of the response", "schema": {"type": "string"}},
+					{"name": "delay_ms", "in": "query", "description": "Wait before sending the headers", "schema": {"type": "integer", "minimum": 0, "maximum": 30000}},
+					{"name": "chunk_delay_ms", "in": "query", "description": "Send the body chunked in 1 KiB chunks and wait this long between them", "schema": {"type": "integer", "minimum": 0, "maximum": 30000}},
+					{"name": "redirect", "in": "query", "description": "Location to redirect to. The status defaults to 302.", "schema": {"type": "string"}}
+				],
 				"responses": {
 					"200": {
 						"description": "A JSON object with debug information about the request and additional metadata.",
@@ -65,13 +178,62 @@ var openapiDocument = `
 								"schema": {
 									"type": "object",
 									"properties": {
-										"server": {"type": "string"},
-										"time": {"type": "string"},
+										"server": {"type": "string", "description": "ID of the server that answered"},
+										"time": {"type": "string", "format": "date-time"},
+										"request_id": {"type": "string", "description": "ID assigned to the request by the request ID middleware"},
+										"method": {"type": "string"},
 										"host": {"type": "string"},
 										"proto": {"type": "string"},
 										"url":  {"type": "object"},
+										"query": {"type": "object", "description": "Query parameters, each with a list of values", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
 										"remoteaddr": {"type": "string"},
-										"headers": {"type": "object"}
+										"headers": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
+										"cookies": {"type": "object", "description": "Cookie values by name", "additionalProperties": {"type": "string"}},
+										"content_length": {"type": "integer", "description": "Declared length of the body, -1 when unknown"},
+										"body": {"type": "string", "description": "The raw body, cut at DEBUG_BODY_BUFFER bytes"},
+										"body_size": {"type": "integer", "description": "Size of the whole body in bytes"},
+										"body_sha256": {"type": "string", "description": "Hex encoded SHA-256 of the whole body"},
+										"body_truncated": {"type": "boolean", "description": "Whether the body was longer than DEBUG_BODY_BUFFER and cut"},
+										"form": {"type": "object", "description": "Decoded URL encoded or multipart form fields", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
+										"files": {
+											"type": "array",
+											"description": "Files uploaded in a multipart body",
+											"items": {
+												"type": "object",
+												"properties": {
+													"field": {"type": "string"},
+													"filename": {"type": "string"},
+													"content_type": {"type": "string"},
+													"size": {"type": "integer"}
+												}
+											}
+										},
+										"trailers": {"type": "object", "additionalProperties": {"type": "array", "items": {"type": "string"}}},
+										"tls": {
+											"type": "object",
+											"description": "The TLS connection, absent for plain HTTP",
+											"properties": {
+												"version": {"type": "string"},
+												"cipher_suite": {"type": "string"},
+												"server_name": {"type": "string", "description": "SNI sent by the client"},
+												"negotiated_protocol": {"type": "string", "description": "Protocol picked with ALPN"},
+												"peer_certificates": {
+													"type": "array",
+													"description": "Client certificate chain, only requested when TLS_CLIENT_CERTS is enabled",
+													"items": {
+														"type": "object",
+														"properties": {
+															"subject": {"type": "string"},
+															"issuer": {"type": "string"},
+															"serial": {"type": "string"},
+															"not_before": {"type": "string", "format": "date-time"},
+															"not_after": {"type": "string", "format": "date-time"},
+															"dns_names": {"type": "array", "items": {"type": "string"}}
+														}
+													}
+												}
+											}
+										}
 									}
 								}
 							}
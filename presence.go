@@ -0,0 +1,112 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Transports a stream client can connect over
+const (
+	TransportWS     = "ws"
+	TransportSSE    = "sse"
+	TransportNDJSON = "ndjson"
+	TransportPoll   = "poll"
+	TransportGRPC   = "grpc"
+)
+
+// A connected stream client as shown by GET /ws/clients
+type ClientInfo struct {
+	ID          string     `json:"id"`
+	Transport   string     `json:"transport"`
+	RemoteAddr  string     `json:"remote_addr"`
+	UserAgent   string     `json:"user_agent"`
+	ConnectedAt time.Time  `json:"connected_at"`
+	Filter      Filter     `json:"filter"`
+	Subscribed  bool       `json:"subscribed"`
+	Paused      bool       `json:"paused"`
+	IntervalMS  int64      `json:"interval_ms"`
+	Room        string     `json:"room,omitempty"`
+	Sent        int64      `json:"sent"`
+	Pending     int        `json:"pending"`
+	Filtered    int        `json:"filtered"`
+	Dropped     int        `json:"dropped"`
+	LastPong    *time.Time `json:"last_pong,omitempty"`
+}
+
+func (h *Hub) listClients() []ClientInfo {
+	infos := make([]ClientInfo, 0, len(h.clients))
+	for client := range h.clients {
+		info := ClientInfo{
+			ID:          client.id,
+			Transport:   client.transport,
+			RemoteAddr:  client.remoteAddr,
+			UserAgent:   client.userAgent,
+			ConnectedAt: client.connectedAt,
+			Filter:      client.filter,
+			Subscribed:  client.subscribed,
+			Paused:      client.paused,
+			IntervalMS:  client.interval.Milliseconds(),
+			Room:        client.roomName,
+			Sent:        atomic.LoadInt64(&client.sent),
+			Pending:     len(client.send),
+			Filtered:    client.filtered,
+			Dropped:     client.dropped,
+		}
+		if pong := atomic.LoadInt64(&client.lastPong); pong != 0 {
+			t := time.Unix(0, pong).UTC()
+			info.LastPong = &t
+		}
+		infos = append(infos, info)
+	}
+
+	// IDs are assigned in order so this lists the oldest clients first
+	sort.Slice(infos, func(i, j int) bool {
+		a, _ := strconv.Atoi(infos[i].ID)
+		b, _ := strconv.Atoi(infos[j].ID)
+		return a < b
+	})
+	return infos
+}
+
+// Lists the connected stream clients to debug why one stopped getting quotes
+func (s *Server) ListClients(w http.ResponseWriter, r *http.Request) {
+	res := make(chan []ClientInfo, 1)
+	select {
+	case s.hub.clientInfos <- res:
+	case <-s.hub.done:
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	resJson, err := json.MarshalIndent(<-res, "", "    ")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(resJson); err != nil {
+		log.Panicln(err)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Version of the JSON stream protocol. Every frame sent by the server carries it.
+const ProtocolVersion = 1
+
+// Types of frames sent by the server
+const (
+	FrameQuote     = "quote"
+	FrameAck       = "ack"
+	FrameError     = "error"
+	FrameHeartbeat = "heartbeat"
+	FrameSession   = "session"
+	FrameBroadcast = "broadcast"
+	FrameChat      = "chat"
+	FrameGoAway    = "goaway"
+)
+
+// Types of messages sent by clients
+const (
+	MsgSubscribe   = "subscribe"
+	MsgUnsubscribe = "unsubscribe"
+	MsgPause       = "pause"
+	MsgResume      = "resume"
+	MsgSetInterval = "set_interval"
+	MsgSay         = "say"
+)
+
+// Attributes of a quote that subscriptions can filter on
+type QuoteMeta struct {
+	Author   string
+	Language string
+	Tags     []string
+}
+
+func newQuoteResult(server, quote string, meta map[string]QuoteMeta) QuoteResult {
+	m := meta[quote]
+	return QuoteResult{
+		Server:   server,
+		Quote:    quote,
+		Time:     time.Now().UTC(),
+		Author:   m.Author,
+		Language: m.Language,
+		Tags:     m.Tags,
+	}
+}
+
+// Restricts the quotes a subscription receives. Empty fields match everything; a quote matches Tags when it
+// carries any of them.
+type Filter struct {
+	Tags     []string `json:"tags,omitempty"`
+	Author   string   `json:"author,omitempty"`
+	Language string   `json:"language,omitempty"`
+}
+
+func (f Filter) Matches(q QuoteResult) bool {
+	if f.Author != "" && !strings.EqualFold(f.Author, q.Author) {
+		return false
+	}
+	if f.Language != "" && !strings.EqualFold(f.Language, q.Language) {
+		return false
+	}
+	if len(f.Tags) == 0 {
+		return true
+	}
+	for _, want := range f.Tags {
+		for _, tag := range q.Tags {
+			if strings.EqualFold(want, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A message sent by a client. ID is optional and echoed back in the matching ack or error frame.
+type ClientMessage struct {
+	Type       string `json:"type"`
+	ID         string `json:"id,omitempty"`
+	Filter     Filter `json:"filter"`
+	IntervalMS int    `json:"interval_ms,omitempty"`
+	Text       string `json:"text,omitempty"`
+}
+
+// A frame sent by the server. Only the fields relevant to the frame type are set. Quote frames carry a sequence
+// number that increases across the whole hub.
+type Frame struct {
+	V       int          `json:"v"`
+	Type    string       `json:"type"`
+	Seq     uint64       `json:"seq,omitempty"`
+	ID      string       `json:"id,omitempty"`
+	Op      string       `json:"op,omitempty"`
+	Quote   *QuoteResult `json:"quote,omitempty"`
+	Code    int          `json:"code,omitempty"`
+	Error   string       `json:"error,omitempty"`
+	Session string       `json:"session,omitempty"`
+	Room    string       `json:"room,omitempty"`
+	Client  string       `json:"client,omitempty"`
+	Message string       `json:"message,omitempty"`
+	RetryMS int64        `json:"retry_ms,omitempty"`
+	Time    time.Time    `json:"time"`
+}
+
+func newFrame(frameType string) *Frame {
+	return &Frame{V: ProtocolVersion, Type: frameType, Time: time.Now().UTC()}
+}
+
+func quoteFrame(q QuoteResult) *Frame {
+	f := newFrame(FrameQuote)
+	f.Quote = &q
+	return f
+}
+
+func ackFrame(msg *ClientMessage) *Frame {
+	f := newFrame(FrameAck)
+	f.ID = msg.ID
+	f.Op = msg.Type
+	return f
+}
+
+func errorFrame(id string, code int, err string) *Frame {
+	f := newFrame(FrameError)
+	f.ID = id
+	f.Code = code
+	f.Error = err
+	return f
+}
+
+func sessionFrame(token, clientID string) *Frame {
+	f := newFrame(FrameSession)
+	f.Session = token
+	f.Client = clientID
+	return f
+}
+
+func broadcastFrame(message string) *Frame {
+	f := newFrame(FrameBroadcast)
+	f.Message = message
+	return f
+}
+
+func chatFrame(room, clientID, text string) *Frame {
+	f := newFrame(FrameChat)
+	f.Room = room
+	f.Client = clientID
+	f.Message = text
+	return f
+}
+
+func goAwayFrame(reconnectAfter time.Duration) *Frame {
+	f := newFrame(FrameGoAway)
+	f.RetryMS = reconnectAfter.Milliseconds()
+	return f
+}
+
+func (f *Frame) Marshal() []byte {
+	data, _ := json.Marshal(f)
+	return data
+}
@@ -14,7 +14,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -22,81 +29,232 @@ import (
 )
 
 const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	// Quote interval for new clients and the bounds a client can ask for.
+	defaultInterval = 1 * time.Second
+	minInterval     = 100 * time.Millisecond
+	maxInterval     = 1 * time.Hour
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	// Send heartbeat frames to clients with this period.
+	heartbeatInterval = 30 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	// Number of recent quote frames kept per session and per room for clients resuming a stream. Smaller than the
+	// default send buffer so a full replay fits in it.
+	historySize = 128
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Smallest send buffer a resuming client fits in: its session frame, an error when the replay is incomplete and
+	// a full replay.
+	minSendQueueSize = historySize + 2
+
+	// How long and how many sessions of disconnected websocket clients are kept for them to resume.
+	sessionTTL  = 5 * time.Minute
+	maxSessions = 1024
+
+	// Number of rooms that can exist at once.
+	maxRooms = 256
 )
 
 type Client struct {
+	// Frames written to the peer and the UnixNano time of the last pong, updated atomically by the pumps. Kept
+	// first so they are 64-bit aligned.
+	sent     int64
+	lastPong int64
+
 	hub  *Hub
 	conn *websocket.Conn
-	send chan []byte
+	opts *wsOptions
+	send chan *Frame
+
+	// Where the client connected from, for GET /ws/clients
+	transport   string
+	remoteAddr  string
+	userAgent   string
+	connectedAt time.Time
+
+	// Owned by the hub's run loop
+	filter     Filter
+	subscribed bool
+	paused     bool
+	interval   time.Duration
+
+	// Sequence number of the last quote the client saw before reconnecting, or 0 for a fresh stream
+	resumeAfter uint64
+	lastSeq     uint64
+
+	// The quotes picked for the client alone, kept with its session so they can be replayed when it resumes
+	picked frameLog
+
+	// Quotes the client was due but did not get because none matched its filter
+	filtered int
+
+	// Frames the client missed because its send buffer was full
+	dropped int
+
+	// What to do when the send buffer is full, the hub's policy when empty
+	overflow string
+
+	// Identifies the client to broadcasts. Assigned by the hub when the client registers.
+	id string
+
+	// Resumable clients get a session token they can reconnect with. It is set before registering to resume one.
+	resumable bool
+	session   string
+
+	// The room the client asked to join and the room it is in. Clients in a room get the room's quotes instead of
+	// their own.
+	roomName string
+	room     *Room
+
+	// Frees the client's connection slot, when it holds one
+	release func()
+
+	// Close frame the hub wants sent once it closes the send channel, 0 for a plain close
+	closeCode   int
+	closeReason string
+
+	// Position in the hub's schedule, -1 when the client is not waiting for a quote
+	slot
+}
+
+// A client message handed from readPump to the hub. Err is set when the message could not be parsed.
+type control struct {
+	client *Client
+	msg    *ClientMessage
+	err    string
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, interval time.Duration) *Client {
+	return &Client{
+		hub:        hub,
+		conn:       conn,
+		send:       make(chan *Frame, hub.queueSize),
+		subscribed: true,
+		interval:   interval,
+		slot:       slot{index: -1},
+	}
+}
+
+// Records where the client connected from and over which transport
+func (c *Client) from(r *http.Request, transport string) *Client {
+	c.transport = transport
+	c.remoteAddr = r.RemoteAddr
+	c.userAgent = r.UserAgent()
+	c.connectedAt = time.Now()
+	return c
+}
+
+// What a client asked for in the query string when connecting
+type streamParams struct {
+	filter   Filter
+	interval time.Duration
+	overflow string
+}
+
+func streamOptions(r *http.Request) (streamParams, error) {
+	query := r.URL.Query()
+	p := streamParams{
+		filter:   Filter{Author: query.Get("author"), Language: query.Get("language")},
+		interval: defaultInterval,
+		overflow: query.Get("overflow"),
+	}
+	if tags := query.Get("tags"); tags != "" {
+		p.filter.Tags = strings.Split(tags, ",")
+	}
+
+	if ms := query.Get("interval_ms"); ms != "" {
+		n, err := strconv.Atoi(ms)
+		if err != nil {
+			return p, fmt.Errorf("interval_ms must be a number")
+		}
+		p.interval = time.Duration(n) * time.Millisecond
+		if err := checkInterval(p.interval); err != nil {
+			return p, err
+		}
+	}
+	if p.overflow != "" {
+		if err := checkOverflowPolicy(p.overflow); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// Reports whether the client should get quotes
+func (c *Client) active() bool {
+	return c.subscribed && !c.paused
+}
+
+// Checks a client requested interval against the server bounds
+func checkInterval(interval time.Duration) error {
+	if interval < minInterval || interval > maxInterval {
+		return fmt.Errorf("interval_ms must be between %d and %d", minInterval.Milliseconds(), maxInterval.Milliseconds())
+	}
+	return nil
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.exit(c)
 		c.conn.Close()
+		if c.release != nil {
+			c.release()
+		}
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadLimit(c.opts.maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.opts.pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&c.lastPong, time.Now().UnixNano())
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.pongWait))
+		return nil
+	})
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNoStatusReceived, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
 			}
 			break
 		}
+
+		msg := &ClientMessage{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			c.hub.submit(&control{client: c, err: "malformed message: " + err.Error()})
+			continue
+		}
+		c.hub.submit(&control{client: c, msg: msg})
 	}
 }
 
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.opts.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.pumps.Done()
 	}()
 
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.opts.writeWait))
 			if !ok {
 				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+				msg := []byte{}
+				if c.closeCode != 0 {
+					msg = websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, msg)
 				return
 			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
-			}
 
-			if err := w.Close(); err != nil {
+			// Every frame is its own websocket message so clients can parse them as JSON one by one.
+			if err := c.conn.WriteMessage(websocket.TextMessage, message.Marshal()); err != nil {
 				return
 			}
+			atomic.AddInt64(&c.sent, 1)
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.opts.writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -106,48 +264,312 @@ func (c *Client) writePump() {
 
 type Hub struct {
 	clients    map[*Client]bool
+	schedule   schedule
 	register   chan *Client
 	unregister chan *Client
+	control    chan *control
+	broadcast  chan *broadcast
+
+	// Sequence number of the last quote frame
+	seq uint64
+
+	sessions map[string]*session
+	lastID   int
+
+	rooms     map[string]*Room
+	roomInfos chan chan []RoomInfo
+
+	clientInfos chan chan []ClientInfo
+
+	// Size of each client's send buffer, what to do when it fills up and how often that happened per policy
+	queueSize int
+	policy    string
+	overflows map[string]*OverflowCount
+	statsReqs chan chan HubStats
+
+	// Shutdown stops the run loop, which closes done. Pumps counts the goroutines still writing to clients.
+	shutdown chan *shutdown
+	done     chan struct{}
+	pumps    sync.WaitGroup
 
 	server string
 	random *randomzeug.Random
 	quotes []string
+	meta   map[string]QuoteMeta
 }
 
-func newHub(random *randomzeug.Random, quotes []string, serverId string) *Hub {
+func newHub(random *randomzeug.Random, quotes []string, meta map[string]QuoteMeta, serverId string) *Hub {
 	return &Hub{
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		clients:    make(map[*Client]bool),
-		random:     random,
-		server:     serverId,
-		quotes:     quotes,
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		control:     make(chan *control),
+		broadcast:   make(chan *broadcast),
+		clients:     make(map[*Client]bool),
+		sessions:    make(map[string]*session),
+		rooms:       make(map[string]*Room),
+		roomInfos:   make(chan chan []RoomInfo),
+		clientInfos: make(chan chan []ClientInfo),
+		queueSize:   256,
+		policy:      OverflowDisconnect,
+		overflows:   make(map[string]*OverflowCount),
+		statsReqs:   make(chan chan HubStats),
+		shutdown:    make(chan *shutdown),
+		done:        make(chan struct{}),
+		random:      random,
+		server:      serverId,
+		quotes:      quotes,
+		meta:        meta,
+	}
+}
+
+// Hands the client to the hub. Returns false when the hub has shut down. A registered client holds a count in
+// pumps until whatever writes its frames is done.
+func (h *Hub) enter(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Takes the client away from the hub, if it is still running
+func (h *Hub) exit(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// Hands a client message to the hub, if it is still running
+func (h *Hub) submit(c *control) {
+	select {
+	case h.control <- c:
+	case <-h.done:
+	}
+}
+
+// Queues a frame for the client, applying its slow consumer policy when its buffer is full. Returns false when the
+// frame was not queued.
+func (h *Hub) send(client *Client, frame *Frame) bool {
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	if queue(client, frame) {
+		return true
+	}
+	return h.overflow(client, frame)
+}
+
+// Queues a frame without blocking. Returns false when the send buffer is full.
+func queue(client *Client, frame *Frame) bool {
+	select {
+	case client.send <- frame:
+		if frame.Seq > client.lastSeq {
+			client.lastSeq = frame.Seq
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *Hub) drop(client *Client) {
+	h.schedule.remove(client)
+	delete(h.clients, client)
+	close(client.send)
+	h.retain(client, time.Now())
+	h.leave(client)
+}
+
+// Adds or removes the client from the schedule to match its state. A client that becomes active outside of a room
+// gets its first quote one interval from now.
+func (h *Hub) update(client *Client, now time.Time) {
+	scheduled := client.active() && client.room == nil
+	switch {
+	case scheduled && client.index < 0:
+		h.schedule.add(client, now.Add(client.interval))
+	case !scheduled && client.index >= 0:
+		h.schedule.remove(client)
+	}
+}
+
+// Numbers a quote frame
+func (h *Hub) publish(frame *Frame) *Frame {
+	h.seq++
+	frame.Seq = h.seq
+	return frame
+}
+
+// Re-sends the quotes after the client's resume point that were sent to its room or, outside of a room, that its
+// session was sent. Other clients' quotes are never replayed, so a client without a session or room gets nothing.
+// The client gets a Gone error first when some of the quotes it missed are no longer recorded.
+func (h *Hub) replay(client *Client) {
+	missed := &client.picked
+	if client.room != nil {
+		missed = &client.room.history
+	}
+	frames, trimmed := missed.since(client.resumeAfter)
+	if trimmed {
+		h.send(client, errorFrame("", http.StatusGone, fmt.Sprintf("quotes after seq %d are no longer buffered, resuming from seq %d", client.resumeAfter, frames[0].Seq)))
+	}
+	for _, frame := range frames {
+		h.send(client, frame)
+	}
+}
+
+// Picks a random quote matching the filter. Returns false when no quote matches.
+func (h *Hub) pick(filter Filter) (QuoteResult, bool) {
+	var candidates []string
+	for _, quote := range h.quotes {
+		if filter.Matches(newQuoteResult(h.server, quote, h.meta)) {
+			candidates = append(candidates, quote)
+		}
+	}
+	if len(candidates) == 0 {
+		return QuoteResult{}, false
+	}
+	return newQuoteResult(h.server, h.random.RandomSelectionFromStringSlice(candidates), h.meta), true
+}
+
+func (h *Hub) handle(c *control, now time.Time) {
+	if c.err != "" {
+		h.send(c.client, errorFrame("", http.StatusBadRequest, c.err))
+		return
+	}
+
+	msg := c.msg
+	switch msg.Type {
+	case MsgSubscribe:
+		c.client.filter = msg.Filter
+		c.client.subscribed = true
+	case MsgUnsubscribe:
+		c.client.filter = Filter{}
+		c.client.subscribed = false
+	case MsgPause:
+		c.client.paused = true
+	case MsgResume:
+		c.client.paused = false
+	case MsgSetInterval:
+		interval := time.Duration(msg.IntervalMS) * time.Millisecond
+		if err := checkInterval(interval); err != nil {
+			h.send(c.client, errorFrame(msg.ID, http.StatusBadRequest, err.Error()))
+			return
+		}
+		c.client.interval = interval
+		h.schedule.reschedule(c.client, now.Add(interval))
+	case MsgSay:
+		if c.client.room == nil {
+			h.send(c.client, errorFrame(msg.ID, http.StatusConflict, "not in a room"))
+			return
+		}
+		h.say(c.client, msg.Text)
+	default:
+		h.send(c.client, errorFrame(msg.ID, http.StatusBadRequest, fmt.Sprintf("unknown message type %q", msg.Type)))
+		return
+	}
+	h.update(c.client, now)
+	h.send(c.client, ackFrame(msg))
+}
+
+// Sends a quote to every client and room that is due and schedules its next one
+func (h *Hub) tick(now time.Time) {
+	for next := h.schedule.next(); next != nil && !next.position().due.After(now); next = h.schedule.next() {
+		switch item := next.(type) {
+		case *Client:
+			h.advance(item, item.interval, now)
+			if quote, ok := h.pick(item.filter); ok {
+				frame := h.publish(quoteFrame(quote))
+				item.picked.add(frame)
+				h.send(item, frame)
+			} else {
+				item.filtered++
+			}
+		case *Room:
+			h.advance(item, item.interval, now)
+			h.roomQuote(item)
+		}
+	}
+}
+
+// Schedules the next quote one interval after the last, skipping missed slots rather than bursting to catch up
+func (h *Hub) advance(item scheduled, interval time.Duration, now time.Time) {
+	due := item.position().due.Add(interval)
+	if due.Before(now) {
+		due = now.Add(interval)
+	}
+	h.schedule.reschedule(item, due)
+}
+
+// Arms the timer for the client or room due soonest
+func (h *Hub) arm(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	if next := h.schedule.next(); next != nil {
+		timer.Reset(time.Until(next.position().due))
 	}
 }
 
 func (h *Hub) run() {
-	ticker := time.NewTicker(1 * time.Second)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	timer := time.NewTimer(0)
+	defer func() {
+		heartbeat.Stop()
+		timer.Stop()
+		close(h.done)
+	}()
 
 	for {
 		select {
 		case client := <-h.register:
-			log.Println("client registered")
+			h.pumps.Add(1)
+			if client.overflow == "" {
+				client.overflow = h.policy
+			}
+			h.lastID++
+			client.id = strconv.Itoa(h.lastID)
+			log.Printf("client %s registered\n", client.id)
 			h.clients[client] = true
+			if client.resumable {
+				h.resume(client, time.Now())
+			}
+			h.join(client, time.Now())
+			if client.resumeAfter > 0 {
+				h.replay(client)
+			}
+			h.update(client, time.Now())
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.drop(client)
 				log.Println("client unregistered")
 			}
-		case <-ticker.C:
+		case c := <-h.control:
+			if _, ok := h.clients[c.client]; ok {
+				h.handle(c, time.Now())
+			}
+		case b := <-h.broadcast:
+			b.result <- h.fanOut(b)
+		case res := <-h.roomInfos:
+			res <- h.listRooms()
+		case res := <-h.clientInfos:
+			res <- h.listClients()
+		case res := <-h.statsReqs:
+			res <- h.stats()
+		case now := <-heartbeat.C:
+			h.expire(now)
 			for client := range h.clients {
-				select {
-				case client.send <- []byte(h.server + ": " + h.random.RandomSelectionFromStringSlice(h.quotes)):
-				default:
-					close(client.send)
-					delete(h.clients, client)
-				}
+				h.send(client, newFrame(FrameHeartbeat))
 			}
+		case now := <-timer.C:
+			h.tick(now)
+		case req := <-h.shutdown:
+			req.clients = h.goAway(req.reconnectAfter)
+			return
 		}
+		h.arm(timer)
 	}
 }
@@ -0,0 +1,663 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/gorilla/websocket"
+	"github.com/plombardi89/gozeug/randomzeug"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStreamServer(t *testing.T) (*Server, *httptest.Server) {
+	s := &Server{
+		id:     "test-server",
+		quotes: []string{"funny", "serious"},
+		meta: map[string]QuoteMeta{
+			"funny":   {Author: "Alice", Language: "en", Tags: []string{"humor"}},
+			"serious": {Author: "Bob", Language: "de", Tags: []string{"philosophy"}},
+		},
+		random: randomzeug.NewRandom(),
+		wsOpts: defaultWSOptions(),
+	}
+	s.hub = newHub(s.random, s.quotes, s.meta, s.id)
+	go s.hub.run()
+
+	ts := httptest.NewServer(http.HandlerFunc(s.StreamQuotes))
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func dialStream(t *testing.T, ts *httptest.Server, query string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestServer_StreamQuotesProtocol(t *testing.T) {
+	_, ts := newTestStreamServer(t)
+	conn := dialStream(t, ts, "")
+
+	frame := Frame{}
+	assert.NoError(t, conn.ReadJSON(&frame))
+	assert.Equal(t, FrameSession, frame.Type)
+	assert.NotEmpty(t, frame.Session)
+
+	assert.NoError(t, conn.WriteJSON(ClientMessage{Type: MsgSubscribe, ID: "1", Filter: Filter{Tags: []string{"humor"}}}))
+
+	frame = Frame{}
+	assert.NoError(t, conn.ReadJSON(&frame))
+	assert.Equal(t, FrameAck, frame.Type)
+	assert.Equal(t, "1", frame.ID)
+	assert.Equal(t, ProtocolVersion, frame.V)
+
+	for i := 0; i < 2; i++ {
+		frame = Frame{}
+		assert.NoError(t, conn.ReadJSON(&frame))
+		assert.Equal(t, FrameQuote, frame.Type)
+		if assert.NotNil(t, frame.Quote) {
+			assert.Equal(t, "funny", frame.Quote.Quote)
+			assert.Equal(t, "Alice", frame.Quote.Author)
+		}
+	}
+
+	assert.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"dance","id":"2"}`)))
+	for frame.Type != FrameError {
+		frame = Frame{}
+		assert.NoError(t, conn.ReadJSON(&frame))
+	}
+	assert.Equal(t, "2", frame.ID)
+	assert.Equal(t, http.StatusBadRequest, frame.Code)
+}
+
+func TestServer_StreamQuotesInterval(t *testing.T) {
+	_, ts := newTestStreamServer(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?interval_ms=10", nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	fast := dialStream(t, ts, "?interval_ms=100")
+	slow := dialStream(t, ts, "")
+
+	readFrame(t, fast, FrameSession)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		frame := Frame{}
+		assert.NoError(t, fast.ReadJSON(&frame))
+		assert.Equal(t, FrameQuote, frame.Type)
+	}
+	assert.True(t, time.Since(start) < defaultInterval, "fast client should get three quotes within a second")
+
+	assert.NoError(t, slow.WriteJSON(ClientMessage{Type: MsgSetInterval, ID: "1", IntervalMS: int(2 * maxInterval.Milliseconds())}))
+	frame := readFrame(t, slow, FrameError)
+	assert.Equal(t, "1", frame.ID)
+}
+
+// Reads frames until one of the given type arrives
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string) Frame {
+	for {
+		frame := Frame{}
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+func TestServer_StreamQuotesResume(t *testing.T) {
+	_, ts := newTestStreamServer(t)
+	conn := dialStream(t, ts, "?interval_ms=100&author=bob")
+
+	token := readFrame(t, conn, FrameSession).Session
+	first := readFrame(t, conn, FrameQuote)
+	second := readFrame(t, conn, FrameQuote)
+	conn.Close()
+
+	conn = dialStream(t, ts, "?resume="+token)
+	assert.Equal(t, token, readFrame(t, conn, FrameSession).Session)
+	replayed := readFrame(t, conn, FrameQuote)
+	assert.True(t, replayed.Seq > first.Seq)
+	if assert.NotNil(t, replayed.Quote) {
+		assert.Equal(t, "Bob", replayed.Quote.Author)
+	}
+	assert.True(t, replayed.Seq >= second.Seq)
+
+	conn = dialStream(t, ts, "?resume=bogus")
+	frame := readFrame(t, conn, FrameError)
+	assert.Equal(t, http.StatusGone, frame.Code)
+}
+
+func TestHub_ReplayGap(t *testing.T) {
+	hub := newHub(randomzeug.NewRandom(), []string{"funny"}, nil, "test-server")
+	client := newClient(hub, nil, defaultInterval)
+	for i := 0; i < historySize+10; i++ {
+		quote, _ := hub.pick(Filter{})
+		client.picked.add(hub.publish(quoteFrame(quote)))
+	}
+
+	client.resumeAfter = 1
+	hub.clients[client] = true
+	hub.replay(client)
+
+	frame := <-client.send
+	assert.Equal(t, FrameError, frame.Type)
+	assert.Equal(t, http.StatusGone, frame.Code)
+	frame = <-client.send
+	assert.Equal(t, uint64(11), frame.Seq)
+	assert.Len(t, client.send, historySize-1)
+}
+
+func TestHub_ReplayOwnQuotes(t *testing.T) {
+	hub := newHub(randomzeug.NewRandom(), []string{"funny"}, nil, "test-server")
+	quote, _ := hub.pick(Filter{})
+
+	// Another client's quotes and another room's quotes are interleaved with the ones this client missed
+	mine, other := newClient(hub, nil, defaultInterval), newClient(hub, nil, defaultInterval)
+	room := &Room{name: "lobby"}
+	for i := 0; i < 3; i++ {
+		mine.picked.add(hub.publish(quoteFrame(quote)))
+		other.picked.add(hub.publish(quoteFrame(quote)))
+		frame := quoteFrame(quote)
+		frame.Room = room.name
+		room.history.add(hub.publish(frame))
+	}
+
+	mine.resumeAfter = 1
+	hub.clients[mine] = true
+	hub.replay(mine)
+	assert.Equal(t, uint64(4), (<-mine.send).Seq)
+	assert.Equal(t, uint64(7), (<-mine.send).Seq)
+	assert.Len(t, mine.send, 0)
+
+	member := newClient(hub, nil, defaultInterval)
+	member.room = room
+	member.resumeAfter = 3
+	hub.clients[member] = true
+	hub.replay(member)
+	assert.Equal(t, uint64(6), (<-member.send).Seq)
+	assert.Equal(t, uint64(9), (<-member.send).Seq)
+	assert.Len(t, member.send, 0)
+
+	// Without a session or room there is nothing of the client's own to replay
+	fresh := newClient(hub, nil, defaultInterval)
+	fresh.resumeAfter = 1
+	hub.clients[fresh] = true
+	hub.replay(fresh)
+	assert.Len(t, fresh.send, 0)
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) (id, event string, frame Frame) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, frame
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &frame))
+		}
+	}
+}
+
+func TestServer_StreamEvents(t *testing.T) {
+	s, _ := newTestStreamServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(s.StreamEvents))
+	t.Cleanup(ts.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/sse?tags=philosophy&interval_ms=100", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	var ids []string
+	reader := bufio.NewReader(res.Body)
+	for i := 0; i < 2; i++ {
+		id, event, frame := readEvent(t, reader)
+		assert.Equal(t, FrameQuote, event)
+		assert.Equal(t, strconv.FormatUint(frame.Seq, 10), id)
+		if assert.NotNil(t, frame.Quote) {
+			assert.Equal(t, "serious", frame.Quote.Quote)
+		}
+		ids = append(ids, id)
+	}
+	cancel()
+	res.Body.Close()
+
+	// The stream's quotes were its own, so a reconnect starts afresh rather than replaying other clients' quotes
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/sse?tags=philosophy&interval_ms=100", nil)
+	req.Header.Set("Last-Event-ID", ids[0])
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	id, _, _ := readEvent(t, bufio.NewReader(res.Body))
+	next, _ := strconv.ParseUint(id, 10, 64)
+	last, _ := strconv.ParseUint(ids[1], 10, 64)
+	assert.True(t, next > last)
+}
+
+func TestServer_PollAndStreamNDJSON(t *testing.T) {
+	s, _ := newTestStreamServer(t)
+	ts := httptest.NewServer(http.HandlerFunc(s.PollQuotes))
+	t.Cleanup(ts.Close)
+
+	res, err := http.Get(ts.URL + "/poll?author=alice&interval_ms=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []Frame
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&frames))
+	res.Body.Close()
+	if assert.NotEmpty(t, frames) && assert.NotNil(t, frames[0].Quote) {
+		assert.Equal(t, "Alice", frames[0].Quote.Author)
+	}
+
+	res, err = http.Get(ts.URL + "/poll?author=nobody&timeout_ms=200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	stream := httptest.NewServer(http.HandlerFunc(s.StreamNDJSON))
+	t.Cleanup(stream.Close)
+
+	res, err = http.Get(stream.URL + "/stream?interval_ms=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+
+	decoder := json.NewDecoder(res.Body)
+	for i := 0; i < 2; i++ {
+		frame := Frame{}
+		assert.NoError(t, decoder.Decode(&frame))
+		assert.Equal(t, FrameQuote, frame.Type)
+		assert.True(t, frame.Seq > 0)
+	}
+}
+
+func TestServer_Broadcast(t *testing.T) {
+	s, ts := newTestStreamServer(t)
+	humor := dialStream(t, ts, "?tags=humor")
+	plain := dialStream(t, ts, "")
+	id := readFrame(t, plain, FrameSession).Client
+	assert.NotEmpty(t, id)
+	readFrame(t, humor, FrameSession)
+
+	broadcast := func(body string) (*httptest.ResponseRecorder, BroadcastResult) {
+		w := httptest.NewRecorder()
+		s.Broadcast(w, httptest.NewRequest(http.MethodPost, "/broadcast", strings.NewReader(body)))
+		res := BroadcastResult{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w, res
+	}
+
+	_, res := broadcast(`{"message": "hello everyone"}`)
+	assert.Equal(t, BroadcastResult{Targeted: 2}, res)
+	assert.Equal(t, "hello everyone", readFrame(t, humor, FrameBroadcast).Message)
+	assert.Equal(t, "hello everyone", readFrame(t, plain, FrameBroadcast).Message)
+
+	_, res = broadcast(`{"message": "knock knock", "topic": "HUMOR"}`)
+	assert.Equal(t, BroadcastResult{Targeted: 1}, res)
+	assert.Equal(t, "knock knock", readFrame(t, humor, FrameBroadcast).Message)
+
+	_, res = broadcast(`{"message": "just you", "client": "` + id + `"}`)
+	assert.Equal(t, BroadcastResult{Targeted: 1}, res)
+	assert.Equal(t, "just you", readFrame(t, plain, FrameBroadcast).Message)
+
+	w, _ := broadcast(`{"topic": "humor"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServer_StreamQuotesRooms(t *testing.T) {
+	s, ts := newTestStreamServer(t)
+	alice := dialStream(t, ts, "?room=keynote&author=alice&interval_ms=100")
+	bob := dialStream(t, ts, "?room=keynote&author=bob")
+	readFrame(t, alice, FrameSession)
+	bobID := readFrame(t, bob, FrameSession).Client
+
+	// The room keeps the filter and interval of the client that opened it
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		frame := readFrame(t, conn, FrameQuote)
+		assert.Equal(t, "keynote", frame.Room)
+		if assert.NotNil(t, frame.Quote) {
+			assert.Equal(t, "Alice", frame.Quote.Author)
+		}
+	}
+
+	assert.NoError(t, bob.WriteJSON(ClientMessage{Type: MsgSay, Text: "vote for quote 3"}))
+	frame := readFrame(t, alice, FrameChat)
+	assert.Equal(t, "vote for quote 3", frame.Message)
+	assert.Equal(t, bobID, frame.Client)
+
+	listRooms := func() []RoomInfo {
+		w := httptest.NewRecorder()
+		s.ListRooms(w, httptest.NewRequest(http.MethodGet, "/rooms", nil))
+		var rooms []RoomInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rooms))
+		return rooms
+	}
+	assert.Equal(t, []RoomInfo{{Name: "keynote", Members: 2, IntervalMS: 100, Filter: Filter{Author: "alice"}}}, listRooms())
+
+	alice.Close()
+	bob.Close()
+	for deadline := time.Now().Add(5 * time.Second); len(listRooms()) > 0; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("empty room was not removed")
+		}
+	}
+}
+
+func TestServer_StreamQuotesConnectionGuards(t *testing.T) {
+	s, ts := newTestStreamServer(t)
+	s.wsOpts.allowedOrigins = []string{"https://demo.example.com"}
+	s.wsOpts.cookie = "quote-cookie=ws"
+	s.upgrader = s.wsOpts.upgrader()
+	s.wsLimit = newConnLimiter(0, 1, nil)
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example.com"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{wsSubprotocol}}
+	conn, resp, err := dialer.Dial(url, http.Header{"Origin": {"https://demo.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, wsSubprotocol, conn.Subprotocol())
+	assert.Equal(t, "quote-cookie=ws", resp.Header.Get("Set-Cookie"))
+
+	_, resp, err = websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	}
+
+	// The slot is freed once the first connection closes
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if conn, _, err = websocket.DefaultDialer.Dial(url, nil); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnLimiter_IgnoresForwardedFor(t *testing.T) {
+	limiter := newConnLimiter(0, 1, nil)
+	var statuses []int
+	handler := rememberPeer(middleware.RealIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := limiter.acquire(r)
+		statuses = append(statuses, status)
+	})))
+
+	for _, forwarded := range []string{"198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", forwarded)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, []int{0, http.StatusTooManyRequests}, statuses)
+}
+
+func TestConnLimiter_TrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newConnLimiter(0, 1, trusted)
+	acquire := func(peer, forwarded string) int {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		req.RemoteAddr = peer
+		req.Header.Set("X-Forwarded-For", forwarded)
+		status, _ := limiter.acquire(req)
+		return status
+	}
+
+	// Behind the gateway each browser counts on its own, whatever hops it made up before reaching the gateway
+	assert.Equal(t, 0, acquire("10.1.2.3:1234", "198.51.100.1"))
+	assert.Equal(t, 0, acquire("10.1.2.3:1234", "198.51.100.2"))
+	assert.Equal(t, http.StatusTooManyRequests, acquire("192.0.2.1:1234", "203.0.113.9, 198.51.100.1, 10.4.4.4"))
+
+	// Untrusted peers count as themselves
+	assert.Equal(t, 0, acquire("203.0.113.7:1234", "198.51.100.3"))
+	assert.Equal(t, http.StatusTooManyRequests, acquire("203.0.113.7:1234", "198.51.100.4"))
+
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	assert.Error(t, err)
+}
+
+func TestLoadWSOptions_Cookie(t *testing.T) {
+	o, err := loadWSOptions()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "quote-cookie=ws", o.cookie)
+	}
+
+	os.Setenv(EnvWSCookie, "")
+	defer os.Unsetenv(EnvWSCookie)
+	o, err = loadWSOptions()
+	if assert.NoError(t, err) {
+		assert.Empty(t, o.cookie)
+	}
+}
+
+func TestLoadWSOptions_PongWait(t *testing.T) {
+	defer os.Unsetenv(EnvWSPongWait)
+	for _, v := range []string{"1ns", "999ms", "0s"} {
+		os.Setenv(EnvWSPongWait, v)
+		_, err := loadWSOptions()
+		assert.Error(t, err, v)
+	}
+
+	os.Setenv(EnvWSPongWait, "1s")
+	o, err := loadWSOptions()
+	if assert.NoError(t, err) {
+		assert.True(t, o.pingPeriod() > 0)
+	}
+}
+
+func TestLoadWSOptions_SendQueueSize(t *testing.T) {
+	defer os.Unsetenv(EnvWSSendQueueSize)
+	for _, v := range []string{"1", "128", "129"} {
+		os.Setenv(EnvWSSendQueueSize, v)
+		_, err := loadWSOptions()
+		assert.Error(t, err, v)
+	}
+
+	os.Setenv(EnvWSSendQueueSize, "130")
+	o, err := loadWSOptions()
+	if assert.NoError(t, err) {
+		assert.Equal(t, 130, o.sendQueueSize)
+	}
+}
+
+func TestServer_StreamQuotesCompression(t *testing.T) {
+	s, ts := newTestStreamServer(t)
+	s.wsOpts.compression = true
+	s.wsOpts.compressionLevel = 9
+	s.upgrader = s.wsOpts.upgrader()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?interval_ms=100", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	assert.NotNil(t, readFrame(t, conn, FrameQuote).Quote)
+}
+
+func TestHub_Shutdown(t *testing.T) {
+	s, ts := newTestStreamServer(t)
+	conn := dialStream(t, ts, "")
+	readFrame(t, conn, FrameSession)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clients, drained := s.hub.Shutdown(ctx, 3*time.Second)
+	assert.Equal(t, 1, clients)
+	assert.True(t, drained)
+
+	assert.Equal(t, int64(3000), readFrame(t, conn, FrameGoAway).RetryMS)
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "expected a going away close, got %v", err)
+
+	conn = dialStream(t, ts, "")
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "expected a going away close, got %v", err)
+}
+
+func TestHub_ShutdownDropNewest(t *testing.T) {
+	hub := newHub(randomzeug.NewRandom(), []string{"funny"}, nil, "test-server")
+	hub.queueSize = 1
+	go hub.run()
+
+	// A slow client whose buffer is full when the goaway is sent, so drop-newest discards it
+	client := newClient(hub, nil, defaultInterval)
+	client.overflow = OverflowDropNewest
+	client.send <- ackFrame(&ClientMessage{Type: MsgPause})
+	assert.True(t, hub.enter(client))
+	go func() {
+		<-hub.done
+		for range client.send {
+		}
+		hub.pumps.Done()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	clients, drained := hub.Shutdown(ctx, 0)
+	assert.Equal(t, 1, clients)
+	assert.True(t, drained)
+}
+
+func TestServer_ListClients(t *testing.T) {
+	s, ts := newTestStreamServer(t)
+	s.wsOpts.pongWait = 200 * time.Millisecond
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?tags=nothing&interval_ms=100", http.Header{"User-Agent": {"demo-browser"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Reading lets the client answer pings while the quote ticks find nothing matching its filter
+	id := readFrame(t, conn, FrameSession).Client
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	s.ListClients(w, httptest.NewRequest(http.MethodGet, "/ws/clients", nil))
+	var clients []ClientInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &clients))
+
+	if assert.Len(t, clients, 1) {
+		c := clients[0]
+		assert.Equal(t, id, c.ID)
+		assert.Equal(t, TransportWS, c.Transport)
+		assert.Equal(t, "demo-browser", c.UserAgent)
+		assert.Equal(t, []string{"nothing"}, c.Filter.Tags)
+		assert.Equal(t, int64(1), c.Sent)
+		assert.True(t, c.Filtered > 0)
+		assert.Zero(t, c.Dropped)
+		assert.NotNil(t, c.LastPong)
+	}
+}
+
+func TestHub_Overflow(t *testing.T) {
+	hub := newHub(randomzeug.NewRandom(), []string{"funny"}, nil, "test-server")
+	hub.queueSize = 2
+
+	fill := func(policy string) *Client {
+		client := newClient(hub, nil, defaultInterval)
+		client.overflow = policy
+		hub.clients[client] = true
+		hub.send(client, ackFrame(&ClientMessage{Type: MsgPause}))
+		for i := 0; i < 3; i++ {
+			quote, _ := hub.pick(Filter{})
+			hub.send(client, hub.publish(quoteFrame(quote)))
+		}
+		return client
+	}
+
+	client := fill(OverflowDisconnect)
+	assert.False(t, hub.clients[client])
+
+	client = fill(OverflowDropNewest)
+	assert.Equal(t, FrameAck, (<-client.send).Type)
+	assert.Equal(t, hub.seq-2, (<-client.send).Seq)
+
+	client = fill(OverflowDropOldest)
+	assert.Equal(t, hub.seq-1, (<-client.send).Seq)
+	assert.Equal(t, hub.seq, (<-client.send).Seq)
+
+	client = fill(OverflowCoalesce)
+	assert.Equal(t, FrameAck, (<-client.send).Type)
+	assert.Equal(t, hub.seq, (<-client.send).Seq)
+
+	stats := hub.stats()
+	assert.Equal(t, OverflowCount{Disconnected: 1}, *stats.Overflows[OverflowDisconnect])
+	assert.Equal(t, OverflowCount{Dropped: 2}, *stats.Overflows[OverflowDropNewest])
+	assert.Equal(t, OverflowCount{Dropped: 2}, *stats.Overflows[OverflowDropOldest])
+	assert.Equal(t, OverflowCount{Dropped: 2}, *stats.Overflows[OverflowCoalesce])
+}
@@ -0,0 +1,229 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+)
+
+const (
+	PermQuotesRead  = "quotes:read"
+	PermFilesRead   = "files:read"
+	PermFilesWrite  = "files:write"
+	PermFilesDelete = "files:delete"
+	PermAdminConfig = "admin:config"
+	PermWSBroadcast = "ws:broadcast"
+
+	anonymousName = "anonymous"
+)
+
+// Maps roles to permissions and identities to roles. Credential scopes are granted on top of the role permissions.
+type Policy struct {
+	Roles     map[string][]string `json:"roles"`
+	Bindings  map[string][]string `json:"bindings"`
+	Default   []string            `json:"default"`
+	Anonymous []string            `json:"anonymous"`
+}
+
+// The built-in viewer/editor/admin roles. Anonymous callers are viewers, so writes and admin actions stay closed until
+// credentials are configured, unless AUTH_DISABLED makes them admins.
+func defaultPolicy(authDisabled bool) *Policy {
+	viewer := []string{PermQuotesRead, PermFilesRead}
+	editor := append(append([]string{}, viewer...), PermFilesWrite, PermFilesDelete)
+	admin := append(append([]string{}, editor...), PermAdminConfig, PermWSBroadcast)
+
+	p := &Policy{
+		Roles: map[string][]string{
+			"viewer": viewer,
+			"editor": editor,
+			"admin":  admin,
+		},
+		Bindings:  map[string][]string{},
+		Default:   []string{"viewer"},
+		Anonymous: []string{"viewer"},
+	}
+	if authDisabled {
+		p.Anonymous = []string{"admin"}
+	}
+	return p
+}
+
+// Reads the policy from RBAC_POLICY_FILE, falling back to the default policy when it is not set
+func loadPolicy(authDisabled bool) (*Policy, error) {
+	file := os.Getenv(EnvRBACPolicyFile)
+	if file == "" {
+		return defaultPolicy(authDisabled), nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("parsing RBAC policy: %v", err)
+	}
+
+	for _, roles := range append([][]string{p.Default, p.Anonymous}, bindingRoles(p)...) {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return nil, fmt.Errorf("RBAC policy references unknown role %q", role)
+			}
+		}
+	}
+	return p, nil
+}
+
+func bindingRoles(p *Policy) [][]string {
+	var res [][]string
+	for _, roles := range p.Bindings {
+		res = append(res, roles)
+	}
+	return res
+}
+
+// Fills in the roles and effective permissions of an identity
+func (p *Policy) resolve(id *Identity) {
+	roles, ok := p.Bindings[id.Name]
+	if !ok {
+		roles = p.Default
+	}
+	if id.Method == anonymousName {
+		roles = p.Anonymous
+	}
+
+	perms := make(map[string]bool)
+	for _, scope := range id.Scopes {
+		perms[scope] = true
+	}
+	for _, role := range roles {
+		for _, perm := range p.Roles[role] {
+			perms[perm] = true
+		}
+	}
+
+	id.Roles = append([]string{}, roles...)
+	id.Permissions = make([]string, 0, len(perms))
+	for perm := range perms {
+		id.Permissions = append(id.Permissions, perm)
+	}
+	sort.Strings(id.Permissions)
+}
+
+func (i *Identity) Can(perm string) bool {
+	for _, p := range i.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticates the request and resolves the caller's permissions. Requests without credentials resolve to the
+// anonymous identity.
+func (s *Server) resolveIdentity(r *http.Request) (*Identity, error) {
+	var id *Identity
+	if s.auth.Enabled() {
+		var err error
+		if id, err = s.auth.Authenticate(r); err != nil {
+			return nil, err
+		}
+	}
+	if id == nil {
+		id = &Identity{Name: anonymousName, Method: anonymousName}
+	}
+
+	policy := s.policy
+	if policy == nil {
+		policy = defaultPolicy(false)
+	}
+	policy.resolve(id)
+	return id, nil
+}
+
+// Middleware that rejects callers lacking the given permission
+func (s *Server) authorize(perm string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := s.resolveIdentity(r)
+			if err != nil || (!id.Can(perm) && id.Method == anonymousName) {
+				log.Println("ERROR: Unauthenticated request to protected route: ", r.URL.Path)
+				w.Header().Set("WWW-Authenticate", `Basic realm="quote"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !id.Can(perm) {
+				log.Printf("ERROR: %s lacks permission %s for %s\n", id.Name, perm, r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+		})
+	}
+}
+
+func (s *Server) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	id, err := s.resolveIdentity(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="quote"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	resJson, err := json.MarshalIndent(id, "", "    ")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(resJson); err != nil {
+		log.Panicln(err)
+	}
+}
+
+// Returns the RBAC policy currently being enforced
+func (s *Server) GetPolicy(w http.ResponseWriter, r *http.Request) {
+	policy := s.policy
+	if policy == nil {
+		policy = defaultPolicy(false)
+	}
+
+	resJson, err := json.MarshalIndent(policy, "", "    ")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(resJson); err != nil {
+		log.Panicln(err)
+	}
+}
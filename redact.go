@@ -0,0 +1,479 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/openzipkin/zipkin-go"
+)
+
+const defaultRedactionReplacement = "[REDACTED]"
+
+// What to hide before a request is echoed, logged, listed in the history or tagged on a trace span. Header, cookie
+// and query parameter names are case-insensitive globs. JSON paths are dot separated keys into a JSON body where *
+// matches any key or array index; paths with a single key also match query parameters and form fields. Patterns are
+// regular expressions replaced wherever they match in header values, query values, URLs and bodies.
+type RedactionPolicy struct {
+	Headers     []string `json:"headers"`
+	Cookies     []string `json:"cookies"`
+	QueryParams []string `json:"query_params"`
+	JSONPaths   []string `json:"json_paths"`
+	Patterns    []string `json:"patterns"`
+	Replacement string   `json:"replacement"`
+}
+
+// Hides credentials by default: the authorization headers, the API key header and query parameter and the gateway's
+// session and XSRF cookies that the logout page reads. API keys offered as a websocket subprotocol are always hidden.
+func defaultRedactionPolicy(apiKeyHeader, apiKeyParam string) *RedactionPolicy {
+	return &RedactionPolicy{
+		Headers:     []string{"Authorization", "Proxy-Authorization", apiKeyHeader},
+		Cookies:     []string{xsrfCookiePrefix + "*", sessionCookiePrefix + "*"},
+		QueryParams: []string{apiKeyParam},
+	}
+}
+
+// Loads the default policy with what the policy file names added to it
+func loadRedactionPolicy(apiKeyHeader, apiKeyParam string) (*redactor, error) {
+	policy := defaultRedactionPolicy(apiKeyHeader, apiKeyParam)
+	if file := os.Getenv(EnvRedactionPolicyFile); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		extra := &RedactionPolicy{}
+		if err := json.Unmarshal(data, extra); err != nil {
+			return nil, fmt.Errorf("parsing redaction policy: %v", err)
+		}
+		policy.Headers = append(policy.Headers, extra.Headers...)
+		policy.Cookies = append(policy.Cookies, extra.Cookies...)
+		policy.QueryParams = append(policy.QueryParams, extra.QueryParams...)
+		policy.JSONPaths = append(policy.JSONPaths, extra.JSONPaths...)
+		policy.Patterns = append(policy.Patterns, extra.Patterns...)
+		if extra.Replacement != "" {
+			policy.Replacement = extra.Replacement
+		}
+	}
+	return newRedactor(policy)
+}
+
+// Applies a redaction policy. A nil redactor hides nothing.
+type redactor struct {
+	headers     []string
+	cookies     []string
+	params      []string
+	paths       [][]string
+	patterns    []*regexp.Regexp
+	replacement string
+}
+
+func newRedactor(policy *RedactionPolicy) (*redactor, error) {
+	r := &redactor{replacement: policy.Replacement}
+	if r.replacement == "" {
+		r.replacement = defaultRedactionReplacement
+	}
+	for _, name := range policy.Headers {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("redaction header %q: %v", name, err)
+		}
+		r.headers = append(r.headers, strings.ToLower(name))
+	}
+	for _, name := range policy.Cookies {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("redaction cookie %q: %v", name, err)
+		}
+		r.cookies = append(r.cookies, strings.ToLower(name))
+	}
+	for _, name := range policy.QueryParams {
+		if _, err := path.Match(name, ""); err != nil {
+			return nil, fmt.Errorf("redaction query parameter %q: %v", name, err)
+		}
+		r.params = append(r.params, strings.ToLower(name))
+	}
+	for _, p := range policy.JSONPaths {
+		if p == "" {
+			return nil, fmt.Errorf("redaction JSON path must not be empty")
+		}
+		r.paths = append(r.paths, strings.Split(p, "."))
+	}
+	for _, p := range policy.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %v", p, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+func matchesAny(globs []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces every match of the patterns
+func (r *redactor) text(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, re := range r.patterns {
+		s = re.ReplaceAllLiteralString(s, r.replacement)
+	}
+	return s
+}
+
+// Returns a copy of the header with the values of redacted headers and cookies replaced
+func (r *redactor) header(h http.Header) http.Header {
+	if r == nil || h == nil {
+		return h
+	}
+	res := make(http.Header, len(h))
+	for name, values := range h {
+		redacted := make([]string, len(values))
+		for i, v := range values {
+			switch {
+			case matchesAny(r.headers, name):
+				v = r.replacement
+			case http.CanonicalHeaderKey(name) == "Cookie":
+				v = r.cookieHeader(v)
+			case http.CanonicalHeaderKey(name) == "Set-Cookie":
+				v = r.setCookieHeader(v)
+			case http.CanonicalHeaderKey(name) == "Sec-Websocket-Protocol":
+				v = r.subprotocolHeader(v)
+			}
+			redacted[i] = r.text(v)
+		}
+		res[name] = redacted
+	}
+	return res
+}
+
+// Redacts the values of the cookies in a Cookie header, keeping their names and order
+func (r *redactor) cookieHeader(v string) string {
+	pairs := strings.Split(v, ";")
+	for i, pair := range pairs {
+		name := strings.TrimSpace(strings.SplitN(pair, "=", 2)[0])
+		if strings.Contains(pair, "=") && matchesAny(r.cookies, name) {
+			pairs[i] = strings.SplitN(pair, "=", 2)[0] + "=" + r.replacement
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// Redacts the value of a Set-Cookie header, keeping its attributes
+func (r *redactor) setCookieHeader(v string) string {
+	nameValue := strings.SplitN(v, ";", 2)
+	name := strings.TrimSpace(strings.SplitN(nameValue[0], "=", 2)[0])
+	if !strings.Contains(nameValue[0], "=") || !matchesAny(r.cookies, name) {
+		return v
+	}
+	nameValue[0] = name + "=" + r.replacement
+	return strings.Join(nameValue, ";")
+}
+
+// Redacts the API keys offered as apikey.<key> subprotocols, keeping the other subprotocols
+func (r *redactor) subprotocolHeader(v string) string {
+	protocols := strings.Split(v, ",")
+	for i, protocol := range protocols {
+		if trimmed := strings.TrimSpace(protocol); strings.HasPrefix(trimmed, wsAPIKeyProtoPrefix) {
+			protocols[i] = strings.Replace(protocol, trimmed, wsAPIKeyProtoPrefix+r.replacement, 1)
+		}
+	}
+	return strings.Join(protocols, ",")
+}
+
+func (r *redactor) cookieValues(cookies map[string]string) map[string]string {
+	if r == nil {
+		return cookies
+	}
+	res := make(map[string]string, len(cookies))
+	for name, v := range cookies {
+		if matchesAny(r.cookies, name) {
+			v = r.replacement
+		}
+		res[name] = r.text(v)
+	}
+	return res
+}
+
+// Redacts query or form values. Redacted query parameters and fields named by a single key JSON path are replaced.
+func (r *redactor) values(values map[string][]string) map[string][]string {
+	if r == nil || values == nil {
+		return values
+	}
+	res := make(map[string][]string, len(values))
+	for name, vs := range values {
+		redacted := make([]string, len(vs))
+		for i, v := range vs {
+			if r.field(name) {
+				v = r.replacement
+			}
+			redacted[i] = r.text(v)
+		}
+		res[name] = redacted
+	}
+	return res
+}
+
+func (r *redactor) field(name string) bool {
+	if matchesAny(r.params, name) {
+		return true
+	}
+	for _, p := range r.paths {
+		if len(p) == 1 && (p[0] == "*" || p[0] == name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *redactor) url(u *url.URL) *url.URL {
+	if r == nil || u == nil {
+		return u
+	}
+	res := *u
+	res.Path, res.RawPath, res.RawQuery = r.text(u.Path), "", r.redactQuery(u.RawQuery)
+	return &res
+}
+
+// Redacts the values of a raw query string, keeping the order of its parameters
+func (r *redactor) redactQuery(raw string) string {
+	pairs := strings.Split(raw, "&")
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		name, _ := url.QueryUnescape(kv[0])
+		if len(kv) == 2 && r.field(name) {
+			pairs[i] = kv[0] + "=" + url.QueryEscape(r.replacement)
+		}
+	}
+	return r.text(strings.Join(pairs, "&"))
+}
+
+// Redacts the JSON paths of a JSON body, or the fields of a form body, then the patterns. A JSON body that had paths
+// redacted is re-encoded.
+func (r *redactor) body(contentType, body string) string {
+	if r == nil || body == "" {
+		return body
+	}
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		body = r.redactQuery(body)
+	case mediaType == "multipart/form-data" && params["boundary"] != "":
+		body = r.multipartBody(params["boundary"], body)
+	case len(r.paths) > 0 && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")):
+		var doc interface{}
+		if err := json.Unmarshal([]byte(body), &doc); err == nil {
+			redacted := false
+			for _, p := range r.paths {
+				redacted = r.redactPath(doc, p) || redacted
+			}
+			if redacted {
+				data, _ := json.Marshal(doc)
+				body = string(data)
+			}
+		}
+	}
+	return r.text(body)
+}
+
+// Redacts the form fields of a multipart body, keeping files and the other fields. A body with fields redacted is
+// re-encoded. Whatever follows a part that cannot be parsed, such as the cut end of a truncated body, is replaced as a
+// whole since it may hold a field.
+func (r *redactor) multipartBody(boundary, body string) string {
+	var res strings.Builder
+	w := multipart.NewWriter(&res)
+	if err := w.SetBoundary(boundary); err != nil {
+		return r.replacement
+	}
+
+	reader := multipart.NewReader(strings.NewReader(body), boundary)
+	redacted := false
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			if !redacted {
+				return body
+			}
+			w.Close()
+			return res.String()
+		}
+		if err != nil {
+			return res.String() + r.replacement
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return res.String() + r.replacement
+		}
+		if part.FileName() == "" && r.field(part.FormName()) {
+			data = []byte(r.replacement)
+			redacted = true
+		}
+		pw, _ := w.CreatePart(part.Header)
+		pw.Write(data)
+	}
+}
+
+func (r *redactor) redactPath(doc interface{}, p []string) bool {
+	redacted := false
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if p[0] != "*" && p[0] != key {
+				continue
+			}
+			if len(p) == 1 {
+				node[key] = r.replacement
+				redacted = true
+			} else {
+				redacted = r.redactPath(child, p[1:]) || redacted
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if p[0] != "*" && p[0] != fmt.Sprint(i) {
+				continue
+			}
+			if len(p) == 1 {
+				node[i] = r.replacement
+				redacted = true
+			} else {
+				redacted = r.redactPath(child, p[1:]) || redacted
+			}
+		}
+	}
+	return redacted
+}
+
+// Shortest redacted header or cookie value that is also hidden wherever else it appears. Shorter values would hide
+// unrelated text.
+const minSecretLen = 8
+
+// Returns the values of the redacted headers and cookies of a request, and the API keys of its subprotocols
+func (r *redactor) secrets(h http.Header) []string {
+	var secrets []string
+	add := func(v string) {
+		if len(v) >= minSecretLen {
+			secrets = append(secrets, v)
+		}
+	}
+	for name, values := range h {
+		if matchesAny(r.headers, name) {
+			for _, v := range values {
+				add(v)
+			}
+		}
+	}
+	for _, c := range (&http.Request{Header: h}).Cookies() {
+		if matchesAny(r.cookies, c.Name) {
+			add(c.Value)
+		}
+	}
+	for _, v := range h.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(v, ",") {
+			if protocol = strings.TrimSpace(protocol); strings.HasPrefix(protocol, wsAPIKeyProtoPrefix) {
+				add(strings.TrimPrefix(protocol, wsAPIKeyProtoPrefix))
+			}
+		}
+	}
+	return secrets
+}
+
+// Hides the secrets of a request in a body, such as the XSRF token the logout page embeds in its forms
+func (r *redactor) hide(s string, secrets []string) string {
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, r.replacement, -1)
+	}
+	return s
+}
+
+func (r *redactor) debugInfo(info DebugInfo) DebugInfo {
+	if r == nil {
+		return info
+	}
+	secrets := r.secrets(info.Headers)
+	info.URL = r.url(info.URL)
+	info.Query = r.values(info.Query)
+	info.Headers = r.header(info.Headers)
+	info.Cookies = r.cookieValues(info.Cookies)
+	info.Body = r.hide(r.body(http.Header(info.Headers).Get("Content-Type"), info.Body), secrets)
+	info.Form = r.values(info.Form)
+	info.Trailers = r.header(info.Trailers)
+	return info
+}
+
+// Returns a redacted copy of a history entry
+func (r *redactor) entry(e *HistoryEntry) *HistoryEntry {
+	if r == nil {
+		return e
+	}
+	secrets := r.secrets(e.Headers)
+	res := *e
+	if u, err := url.ParseRequestURI(e.URL); err == nil {
+		res.URL = r.url(u).RequestURI()
+	}
+	res.Path = r.text(e.Path)
+	res.Query = r.values(e.Query)
+	res.Headers = r.header(e.Headers)
+	res.Body = r.hide(r.body(http.Header(e.Headers).Get("Content-Type"), e.Body), secrets)
+	res.Trailers = r.header(e.Trailers)
+	res.ResponseHeaders = r.header(e.ResponseHeaders)
+	res.ResponseBody = r.responseBody(e.Headers, e.ResponseHeaders, e.ResponseBody)
+	return &res
+}
+
+// Redacts the body of the response to a request
+func (r *redactor) responseBody(request, response http.Header, body string) string {
+	if r == nil {
+		return body
+	}
+	return r.hide(r.body(response.Get("Content-Type"), body), r.secrets(request))
+}
+
+func (r *redactor) entries(entries []*HistoryEntry) []*HistoryEntry {
+	res := make([]*HistoryEntry, len(entries))
+	for i, e := range entries {
+		res[i] = r.entry(e)
+	}
+	return res
+}
+
+// Middleware that re-tags the path of the trace span with the patterns applied. The tracing middleware tags the raw
+// path, so this must run inside it.
+func (r *redactor) span(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if sp := zipkin.SpanFromContext(req.Context()); sp != nil {
+			if p := r.text(req.URL.Path); p != req.URL.Path {
+				zipkin.TagHTTPPath.Set(sp, p)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
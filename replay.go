@@ -0,0 +1,243 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	// Marks a replayed request with the ID of the history entry it came from
+	replayHeader = "X-Replay-Of"
+
+	// Largest line diff computed, in lines of one body times lines of the other. Bigger bodies are shown as wholly
+	// replaced rather than spending memory on the comparison.
+	diffMaxCells = 1 << 20
+)
+
+// Headers that belong to the original connection and are not replayed
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+}
+
+// Replays go to a local target, usually this server, whose certificate is self-signed. Redirects are returned rather
+// than followed so they can be compared.
+var replayClient = &http.Client{
+	Timeout:       30 * time.Second,
+	Transport:     &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// The response to a request, as recorded in the history or received when replaying it
+type ReplayResponse struct {
+	Status        int                 `json:"status"`
+	Headers       map[string][]string `json:"headers"`
+	Body          string              `json:"body"`
+	BodyTruncated bool                `json:"body_truncated,omitempty"`
+	DurationMS    float64             `json:"duration_ms"`
+}
+
+// A header whose values differ between the two responses. A missing header has no values.
+type HeaderDiff struct {
+	Name     string   `json:"name"`
+	Original []string `json:"original"`
+	Replayed []string `json:"replayed"`
+}
+
+type ReplayResult struct {
+	ID     uint64 `json:"id"`
+	Target string `json:"target"`
+	// The recorded request body was truncated, so the replay sent only its start
+	RequestTruncated bool           `json:"request_truncated,omitempty"`
+	Original         ReplayResponse `json:"original"`
+	Replayed         ReplayResponse `json:"replayed"`
+	StatusChanged    bool           `json:"status_changed"`
+	HeaderDiff       []HeaderDiff   `json:"header_diff"`
+	// Line diff of the bodies with -, + and space prefixes. Empty when they are equal.
+	BodyDiff string `json:"body_diff,omitempty"`
+}
+
+// Sends a recorded request again to the replay target
+func replay(target string, e *HistoryEntry) (ReplayResponse, error) {
+	req, err := http.NewRequest(e.Method, strings.TrimRight(target, "/")+e.URL, strings.NewReader(e.Body))
+	if err != nil {
+		return ReplayResponse{}, err
+	}
+	for name, values := range e.Headers {
+		if !hopByHopHeaders[name] {
+			req.Header[name] = values
+		}
+	}
+	req.Host = e.Host
+	req.Header.Set(replayHeader, strconv.FormatUint(e.ID, 10))
+
+	start := time.Now()
+	res, err := replayClient.Do(req)
+	if err != nil {
+		return ReplayResponse{}, err
+	}
+	defer res.Body.Close()
+
+	// One byte past the limit is enough to tell the body was truncated, and a streaming target is not read forever
+	body := cappedBuffer{limit: historyMaxBody}
+	if _, err := io.Copy(&body, io.LimitReader(res.Body, historyMaxBody+1)); err != nil {
+		return ReplayResponse{}, err
+	}
+	return ReplayResponse{
+		Status:        res.StatusCode,
+		Headers:       res.Header,
+		Body:          body.String(),
+		BodyTruncated: body.truncated,
+		DurationMS:    float64(time.Since(start).Microseconds()) / 1000,
+	}, nil
+}
+
+func diffHeaders(original, replayed http.Header) []HeaderDiff {
+	names := make(map[string]bool)
+	for name := range original {
+		names[name] = true
+	}
+	for name := range replayed {
+		names[name] = true
+	}
+
+	diffs := []HeaderDiff{}
+	for name := range names {
+		a, b := original[name], replayed[name]
+		if strings.Join(a, "\n") != strings.Join(b, "\n") {
+			diffs = append(diffs, HeaderDiff{Name: name, Original: a, Replayed: b})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return diffs
+}
+
+// Diffs two texts line by line using their longest common subsequence
+func diffLines(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	if len(x)*len(y) > diffMaxCells {
+		var diff strings.Builder
+		for _, line := range x {
+			diff.WriteString("- " + line + "\n")
+		}
+		for _, line := range y {
+			diff.WriteString("+ " + line + "\n")
+		}
+		return diff.String()
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			diff.WriteString("  " + x[i] + "\n")
+			i++
+			j++
+		case j == len(y) || (i < len(x) && lcs[i+1][j] >= lcs[i][j+1]):
+			diff.WriteString("- " + x[i] + "\n")
+			i++
+		default:
+			diff.WriteString("+ " + y[j] + "\n")
+			j++
+		}
+	}
+	return diff.String()
+}
+
+// Re-issues a recorded request to the replay target and compares the response with the recorded one
+func (s *Server) Replay(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id must be a number", http.StatusBadRequest)
+		return
+	}
+	e, ok := s.history.get(id)
+	if !ok {
+		http.Error(w, "No such request in the history", http.StatusNotFound)
+		return
+	}
+
+	replayed, err := replay(s.replayTarget, e)
+	if err != nil {
+		log.Println("ERROR: Could not replay request: ", err)
+		http.Error(w, "Could not replay request: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// The original request is replayed as it was, but the responses are redacted before they are compared
+	replayed.Body = s.redactor.responseBody(e.Headers, replayed.Headers, replayed.Body)
+	replayed.Headers = s.redactor.header(replayed.Headers)
+	e = s.redactor.entry(e)
+
+	result := ReplayResult{
+		ID:               e.ID,
+		Target:           s.replayTarget,
+		RequestTruncated: e.BodyTruncated,
+		Original: ReplayResponse{
+			Status:        e.Status,
+			Headers:       e.ResponseHeaders,
+			Body:          e.ResponseBody,
+			BodyTruncated: e.ResponseBodyTruncated,
+			DurationMS:    e.DurationMS,
+		},
+		Replayed:      replayed,
+		StatusChanged: e.Status != replayed.Status,
+		HeaderDiff:    diffHeaders(e.ResponseHeaders, replayed.Headers),
+		BodyDiff:      diffLines(e.ResponseBody, replayed.Body),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// A named channel on the hub. Every member gets the same quote, picked from the room's filter at the room's
+// interval. Both are set by the client that opens the room and the room is removed when its last member leaves.
+type Room struct {
+	name     string
+	filter   Filter
+	interval time.Duration
+	members  map[*Client]bool
+
+	// The room's recent quotes, for members that resume
+	history frameLog
+
+	slot
+}
+
+// A room and how many clients are in it
+type RoomInfo struct {
+	Name       string `json:"name"`
+	Members    int    `json:"members"`
+	IntervalMS int64  `json:"interval_ms"`
+	Filter     Filter `json:"filter"`
+}
+
+// Puts the client in the room it asked for, opening the room when it does not exist yet
+func (h *Hub) join(client *Client, now time.Time) {
+	if client.roomName == "" {
+		return
+	}
+
+	room, ok := h.rooms[client.roomName]
+	if !ok {
+		if len(h.rooms) >= maxRooms {
+			h.send(client, errorFrame("", http.StatusServiceUnavailable, "too many rooms, not joining "+client.roomName))
+			client.roomName = ""
+			return
+		}
+		room = &Room{
+			name:     client.roomName,
+			filter:   client.filter,
+			interval: client.interval,
+			members:  make(map[*Client]bool),
+			slot:     slot{index: -1},
+		}
+		h.rooms[room.name] = room
+		h.schedule.add(room, now.Add(room.interval))
+		log.Printf("room %s opened\n", room.name)
+	}
+	room.members[client] = true
+	client.room = room
+}
+
+// Takes the client out of its room, removing the room when it was the last member
+func (h *Hub) leave(client *Client) {
+	room := client.room
+	if room == nil {
+		return
+	}
+	delete(room.members, client)
+	client.room = nil
+
+	if len(room.members) == 0 {
+		h.schedule.remove(room)
+		delete(h.rooms, room.name)
+		log.Printf("room %s closed\n", room.name)
+	}
+}
+
+// Sends one quote to every member of the room that is subscribed and not paused
+func (h *Hub) roomQuote(room *Room) {
+	quote, ok := h.pick(room.filter)
+	if !ok {
+		for client := range room.members {
+			client.filtered++
+		}
+		return
+	}
+	frame := quoteFrame(quote)
+	frame.Room = room.name
+	h.publish(frame)
+	room.history.add(frame)
+
+	for client := range room.members {
+		if client.active() {
+			h.send(client, frame)
+		}
+	}
+}
+
+// Relays a chat message from the client to everyone in its room, the client included
+func (h *Hub) say(client *Client, text string) {
+	frame := chatFrame(client.room.name, client.id, text)
+	for member := range client.room.members {
+		h.send(member, frame)
+	}
+}
+
+func (h *Hub) listRooms() []RoomInfo {
+	infos := make([]RoomInfo, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		infos = append(infos, RoomInfo{
+			Name:       room.name,
+			Members:    len(room.members),
+			IntervalMS: room.interval.Milliseconds(),
+			Filter:     room.filter,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Returns the open rooms and their member counts
+func (s *Server) ListRooms(w http.ResponseWriter, r *http.Request) {
+	res := make(chan []RoomInfo, 1)
+	select {
+	case s.hub.roomInfos <- res:
+	case <-s.hub.done:
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	resJson, err := json.MarshalIndent(<-res, "", "    ")
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := w.Write(resJson); err != nil {
+		log.Panicln(err)
+	}
+}
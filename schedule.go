@@ -0,0 +1,87 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// When a scheduled client or room is next due and where it sits in the schedule, or -1 when it is not scheduled
+type slot struct {
+	due   time.Time
+	index int
+}
+
+func (s *slot) position() *slot { return s }
+
+// Anything the hub sends quotes to on a cadence
+type scheduled interface {
+	position() *slot
+}
+
+// A min-heap of clients and rooms ordered by when their next quote is due. The hub keeps a single timer armed for
+// the head of the heap instead of running a ticker per client.
+type schedule []scheduled
+
+func (s schedule) Len() int           { return len(s) }
+func (s schedule) Less(i, j int) bool { return s[i].position().due.Before(s[j].position().due) }
+
+func (s schedule) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+	s[i].position().index = i
+	s[j].position().index = j
+}
+
+func (s *schedule) Push(x interface{}) {
+	item := x.(scheduled)
+	item.position().index = len(*s)
+	*s = append(*s, item)
+}
+
+func (s *schedule) Pop() interface{} {
+	old := *s
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.position().index = -1
+	*s = old[:n-1]
+	return item
+}
+
+func (s *schedule) add(item scheduled, due time.Time) {
+	item.position().due = due
+	heap.Push(s, item)
+}
+
+func (s *schedule) remove(item scheduled) {
+	if item.position().index >= 0 {
+		heap.Remove(s, item.position().index)
+	}
+}
+
+func (s *schedule) reschedule(item scheduled, due time.Time) {
+	item.position().due = due
+	if item.position().index >= 0 {
+		heap.Fix(s, item.position().index)
+	}
+}
+
+// Returns the client or room due soonest, or nil when nothing is scheduled
+func (s schedule) next() scheduled {
+	if len(s) == 0 {
+		return nil
+	}
+	return s[0]
+}
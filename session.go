@@ -0,0 +1,128 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The state of a disconnected websocket client, kept so it can reconnect with its token and pick up where it left
+type session struct {
+	id         string
+	room       string
+	filter     Filter
+	subscribed bool
+	paused     bool
+	interval   time.Duration
+	lastSeq    uint64
+	picked     frameLog
+	expires    time.Time
+}
+
+// Recent quote frames, oldest first, and the sequence number of the newest frame that no longer fit
+type frameLog struct {
+	frames  []*Frame
+	trimmed uint64
+}
+
+func (l *frameLog) add(frame *Frame) {
+	if len(l.frames) == historySize {
+		l.trimmed = l.frames[0].Seq
+		copy(l.frames, l.frames[1:])
+		l.frames = l.frames[:historySize-1]
+	}
+	l.frames = append(l.frames, frame)
+}
+
+// Returns the frames after seq, and whether some of the frames after seq were already trimmed
+func (l *frameLog) since(seq uint64) ([]*Frame, bool) {
+	i := sort.Search(len(l.frames), func(i int) bool { return l.frames[i].Seq > seq })
+	return l.frames[i:], l.trimmed > seq
+}
+
+// Restores the session named by the client's token, or starts a new one. Either way the client is told its token
+// and ID before any quotes.
+func (h *Hub) resume(client *Client, now time.Time) {
+	if client.session != "" {
+		// The old connection may still be registered when a client reconnects before the hub saw it go away
+		for other := range h.clients {
+			if other != client && other.session == client.session {
+				h.drop(other)
+			}
+		}
+
+		s, ok := h.sessions[client.session]
+		if ok && now.Before(s.expires) {
+			delete(h.sessions, client.session)
+			client.id = s.id
+			if client.roomName == "" {
+				client.roomName = s.room
+			}
+			client.filter = s.filter
+			client.subscribed = s.subscribed
+			client.paused = s.paused
+			client.interval = s.interval
+			client.picked = s.picked
+			if s.lastSeq > client.resumeAfter {
+				client.resumeAfter = s.lastSeq
+			}
+		} else {
+			delete(h.sessions, client.session)
+			h.send(client, errorFrame("", http.StatusGone, fmt.Sprintf("unknown or expired resume token %q", client.session)))
+			client.session = ""
+		}
+	}
+	if client.session == "" {
+		client.session = h.random.RandomString(24)
+	}
+	h.send(client, sessionFrame(client.session, client.id))
+}
+
+// Keeps the state of a disconnecting resumable client until the session expires
+func (h *Hub) retain(client *Client, now time.Time) {
+	if !client.resumable || client.session == "" {
+		return
+	}
+	if len(h.sessions) >= maxSessions {
+		h.expire(now)
+		if len(h.sessions) >= maxSessions {
+			log.Println("session limit reached, not keeping session for resume")
+			return
+		}
+	}
+	h.sessions[client.session] = &session{
+		id:         client.id,
+		room:       client.roomName,
+		filter:     client.filter,
+		subscribed: client.subscribed,
+		paused:     client.paused,
+		interval:   client.interval,
+		lastSeq:    client.lastSeq,
+		picked:     client.picked,
+		expires:    now.Add(sessionTTL),
+	}
+}
+
+// Forgets sessions that were not resumed in time
+func (h *Hub) expire(now time.Time) {
+	for token, s := range h.sessions {
+		if !now.Before(s.expires) {
+			delete(h.sessions, token)
+		}
+	}
+}
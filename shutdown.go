@@ -0,0 +1,95 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Asks the hub to stop. The hub fills in Clients with the number of clients that were connected before it closes
+// done.
+type shutdown struct {
+	reconnectAfter time.Duration
+	clients        int
+}
+
+// Tells every client the server is going away and disconnects it. Websocket clients get a 1001 Going Away close
+// frame after a goaway frame carrying the reconnect hint.
+func (h *Hub) goAway(reconnectAfter time.Duration) int {
+	reason := "server shutting down"
+	if reconnectAfter > 0 {
+		reason = fmt.Sprintf("server shutting down, reconnect after %s", reconnectAfter)
+	}
+
+	n := len(h.clients)
+	for client := range h.clients {
+		client.closeCode = websocket.CloseGoingAway
+		client.closeReason = reason
+		h.send(client, goAwayFrame(reconnectAfter))
+		// A full buffer may have kept the goaway out or already dropped the client; either way it has to go
+		if h.clients[client] {
+			h.drop(client)
+		}
+	}
+	return n
+}
+
+// Disconnects every client, stops the run loop and waits until the context is done for the clients' pumps to flush
+// what they were sent. Returns how many clients were connected and whether all of them were drained in time.
+func (h *Hub) Shutdown(ctx context.Context, reconnectAfter time.Duration) (int, bool) {
+	req := &shutdown{reconnectAfter: reconnectAfter}
+	select {
+	case h.shutdown <- req:
+	case <-h.done:
+		return 0, true
+	}
+	<-h.done
+
+	drained := make(chan struct{})
+	go func() {
+		h.pumps.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return req.clients, true
+	case <-ctx.Done():
+		return req.clients, false
+	}
+}
+
+// Drains the hub within the configured deadline and logs how it went
+func (s *Server) drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.wsOpts.drainTimeout)
+	defer cancel()
+
+	if s.grpcHealth != nil {
+		// Health checks report NOT_SERVING from now on
+		s.grpcHealth.Shutdown()
+	}
+
+	start := time.Now()
+	clients, ok := s.hub.Shutdown(ctx, s.wsOpts.reconnectAfter)
+	if ok {
+		log.Printf("drained %d stream sessions in %s\n", clients, time.Since(start).Round(time.Millisecond))
+	} else {
+		log.Printf("timed out after %s draining %d stream sessions\n", s.wsOpts.drainTimeout, clients)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Streams quotes from the hub as server-sent events. Every quote event carries its sequence number as the event ID.
+// The quotes are picked for this stream alone and it has no session to resume, so a reconnecting client's
+// Last-Event-ID has nothing to replay and starts a fresh stream.
+func (s *Server) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	params, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client := newClient(s.hub, nil, params.interval).from(r, TransportSSE)
+	client.filter = params.filter
+	client.overflow = params.overflow
+
+	if !client.hub.enter(client) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client.flushPump(r.Context(), flusher, func(frame *Frame) error {
+		if frame.Seq > 0 {
+			fmt.Fprintf(w, "id: %d\n", frame.Seq)
+		}
+		_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", frame.Type, frame.Marshal())
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		return err
+	})
+}
@@ -0,0 +1,105 @@
+// Lists the realms the browser holds ambassador_xsrf cookies for and logs out of them. This mirrors the
+// server-rendered half of the logout page using nothing but the DOM so it works without network access.
+
+const xsrfPrefix = 'ambassador_xsrf.';
+const logoutAction = '/.ambassador/oauth2/logout';
+
+function getCookies() {
+	let map = {};
+	let list = decodeURIComponent(document.cookie).split(';');
+	for (let i = 0; i < list.length; i++) {
+		let cookie = list[i].trimStart();
+		let eq = cookie.indexOf('=');
+		let key = cookie.slice(0, eq);
+		let val = cookie.slice(eq+1);
+		map[key] = val;
+	}
+	return map;
+}
+
+function realmCookies() {
+	let ret = {};
+	let cookies = getCookies();
+	for (let key in cookies) {
+		if (key.indexOf(xsrfPrefix) == 0) {
+			ret[key.slice(xsrfPrefix.length)] = cookies[key];
+		}
+	}
+	return ret;
+}
+
+function logoutForm(realm, xsrf, label) {
+	let form = document.createElement('form');
+	form.method = 'POST';
+	form.action = logoutAction;
+	for (let [name, value] of [['realm', realm], ['_xsrf', xsrf]]) {
+		let input = document.createElement('input');
+		input.type = 'hidden';
+		input.name = name;
+		input.value = value;
+		form.appendChild(input);
+	}
+	if (label) {
+		let submit = document.createElement('input');
+		submit.type = 'submit';
+		submit.value = label;
+		form.appendChild(submit);
+	}
+	return form;
+}
+
+// Each realm is logged out in its own hidden frame, then the page reloads to confirm.
+function logoutRealm(realm, xsrf) {
+	return new Promise(function(resolve) {
+		let frame = document.createElement('iframe');
+		frame.name = 'logout-' + realm;
+		frame.hidden = true;
+		frame.onload = resolve;
+		document.body.appendChild(frame);
+
+		let form = logoutForm(realm, xsrf);
+		form.target = frame.name;
+		document.body.appendChild(form);
+		form.submit();
+	});
+}
+
+function logoutAll(realms) {
+	let pending = [];
+	for (let realm in realms) {
+		pending.push(logoutRealm(realm, realms[realm]));
+	}
+	Promise.all(pending).then(function() {
+		window.location.search = '?logged_out=all';
+	});
+}
+
+function render(app) {
+	let realms = realmCookies();
+
+	let list = document.createElement('ul');
+	for (let realm in realms) {
+		let item = document.createElement('li');
+		item.appendChild(logoutForm(realm, realms[realm], 'log out of realm ' + realm));
+		list.appendChild(item);
+	}
+	app.appendChild(list);
+
+	if (Object.keys(realms).length > 1) {
+		let button = document.createElement('button');
+		button.textContent = 'log out of all realms';
+		button.addEventListener('click', function() { logoutAll(realms); });
+		app.appendChild(button);
+	}
+}
+
+render(document.getElementById('app'));
+
+// With JS the server-rendered form logs out of every realm at the gateway instead of only clearing the cookies
+let ssrLogoutAll = document.getElementById('logout-all');
+if (ssrLogoutAll) {
+	ssrLogoutAll.addEventListener('submit', function(event) {
+		event.preventDefault();
+		logoutAll(realmCookies());
+	});
+}
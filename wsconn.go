@@ -0,0 +1,343 @@
+// Copyright 2019 Philip Lombardi
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The websocket subprotocol clients offer next to an API key sent as apikey.<key> in Sec-WebSocket-Protocol. Browsers
+// cannot set headers on websockets so this is how they authenticate without putting the key in the URL.
+const (
+	wsSubprotocol       = "quote.v1"
+	wsAPIKeyProtoPrefix = "apikey."
+)
+
+// Shortest WS_PONG_WAIT accepted
+const minPongWait = time.Second
+
+// Tunables of websocket connections, read from WS_* environment variables
+type wsOptions struct {
+	// Buffer sizes of the upgraded connection.
+	readBufferSize  int
+	writeBufferSize int
+
+	// Maximum message size allowed from peer.
+	maxMessageSize int64
+
+	// Time allowed to write a message to the peer.
+	writeWait time.Duration
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait time.Duration
+
+	// Negotiate permessage-deflate and compress frames at this level (-2 to 9, see compress/flate).
+	compression      bool
+	compressionLevel int
+
+	// Origins allowed to connect and caps on open connections. A cap of 0 means no cap.
+	allowedOrigins []string
+	maxConns       int
+	maxConnsPerIP  int
+
+	// Proxies whose X-Forwarded-For names the client the per IP cap counts
+	trustedProxies []*net.IPNet
+
+	// Frames buffered for each stream client and what to do when a client falls behind
+	sendQueueSize int
+	overflow      string
+
+	// Set-Cookie value sent with the upgrade response, if any
+	cookie string
+
+	// On SIGTERM, how long to wait for clients to be flushed and when to tell them to reconnect
+	drainTimeout   time.Duration
+	reconnectAfter time.Duration
+}
+
+func defaultWSOptions() *wsOptions {
+	return &wsOptions{
+		readBufferSize:   1024,
+		writeBufferSize:  1024,
+		maxMessageSize:   512,
+		writeWait:        10 * time.Second,
+		pongWait:         60 * time.Second,
+		compressionLevel: 1,
+		allowedOrigins:   []string{"*"},
+		maxConns:         1024,
+		drainTimeout:     10 * time.Second,
+		sendQueueSize:    256,
+		overflow:         OverflowDisconnect,
+		cookie:           "quote-cookie=ws",
+	}
+}
+
+func loadWSOptions() (*wsOptions, error) {
+	o := defaultWSOptions()
+	ints := map[string]*int{
+		EnvWSReadBufferSize:   &o.readBufferSize,
+		EnvWSWriteBufferSize:  &o.writeBufferSize,
+		EnvWSCompressionLevel: &o.compressionLevel,
+		EnvWSMaxConnections:   &o.maxConns,
+		EnvWSMaxConnsPerIP:    &o.maxConnsPerIP,
+		EnvWSSendQueueSize:    &o.sendQueueSize,
+	}
+	for env, dst := range ints {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", env, err)
+			}
+			*dst = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		EnvWSWriteWait:      &o.writeWait,
+		EnvWSPongWait:       &o.pongWait,
+		EnvWSDrainTimeout:   &o.drainTimeout,
+		EnvWSReconnectAfter: &o.reconnectAfter,
+	}
+	for env, dst := range durations {
+		if v := os.Getenv(env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", env, err)
+			}
+			*dst = d
+		}
+	}
+
+	if v := os.Getenv(EnvWSMaxMessageSize); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", EnvWSMaxMessageSize, err)
+		}
+		o.maxMessageSize = n
+	}
+	if v := os.Getenv(EnvWSCompression); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", EnvWSCompression, err)
+		}
+		o.compression = enabled
+	}
+	if v := os.Getenv(EnvWSAllowedOrigins); v != "" {
+		o.allowedOrigins = strings.Split(v, ",")
+	}
+	if v := os.Getenv(EnvWSTrustedProxies); v != "" {
+		proxies, err := parseTrustedProxies(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", EnvWSTrustedProxies, err)
+		}
+		o.trustedProxies = proxies
+	}
+	if v, ok := os.LookupEnv(EnvWSCookie); ok {
+		o.cookie = v
+	}
+	if v := os.Getenv(EnvWSOverflow); v != "" {
+		if err := checkOverflowPolicy(v); err != nil {
+			return nil, fmt.Errorf("%s: %v", EnvWSOverflow, err)
+		}
+		o.overflow = v
+	}
+	if o.sendQueueSize < minSendQueueSize {
+		// A smaller buffer would overflow replaying the history to a resuming client
+		return nil, fmt.Errorf("%s must be at least %d", EnvWSSendQueueSize, minSendQueueSize)
+	}
+
+	if o.compressionLevel < -2 || o.compressionLevel > 9 {
+		return nil, fmt.Errorf("%s must be between -2 and 9", EnvWSCompressionLevel)
+	}
+	if o.pongWait < minPongWait {
+		// Anything shorter would ping faster than any client could answer, and a zero ping period panics the ticker
+		return nil, fmt.Errorf("%s must be at least %s", EnvWSPongWait, minPongWait)
+	}
+	if o.writeWait <= 0 {
+		return nil, fmt.Errorf("%s must be positive", EnvWSWriteWait)
+	}
+	return o, nil
+}
+
+// Send pings to peer with this period. Must be less than pongWait.
+func (o *wsOptions) pingPeriod() time.Duration {
+	return (o.pongWait * 9) / 10
+}
+
+func (o *wsOptions) upgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		CheckOrigin:       originChecker(o.allowedOrigins),
+		Subprotocols:      []string{wsSubprotocol},
+		ReadBufferSize:    o.readBufferSize,
+		WriteBufferSize:   o.writeBufferSize,
+		EnableCompression: o.compression,
+	}
+}
+
+// Builds a CheckOrigin func for the upgrader. Requests without an Origin header do not come from browsers and are
+// always accepted; "*" accepts every origin.
+func originChecker(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Parses a comma separated list of CIDRs or single IPs
+func parseTrustedProxies(v string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP or CIDR", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+type peerAddrKey struct{}
+
+// Middleware that keeps the address of the connection's peer before middleware.RealIP replaces RemoteAddr with what
+// the X-Forwarded-For and X-Real-IP headers claim
+func rememberPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerAddrKey{}, r.RemoteAddr)))
+	})
+}
+
+// Returns the address of the connection's peer, which unlike RemoteAddr the client cannot choose
+func peerAddr(r *http.Request) string {
+	if addr, ok := r.Context().Value(peerAddrKey{}).(string); ok {
+		return addr
+	}
+	return r.RemoteAddr
+}
+
+// Caps the number of open websocket connections, overall and per client IP. A limit of 0 means no limit.
+type connLimiter struct {
+	maxTotal int
+	maxPerIP int
+	trusted  []*net.IPNet
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(maxTotal, maxPerIP int, trusted []*net.IPNet) *connLimiter {
+	return &connLimiter{maxTotal: maxTotal, maxPerIP: maxPerIP, trusted: trusted, perIP: make(map[string]int)}
+}
+
+// Reserves a connection for the client IP of the request. Returns the HTTP status to reject the request with, or 0 and a func
+// that releases the reservation when the connection closes.
+func (l *connLimiter) acquire(r *http.Request) (int, func()) {
+	if l == nil {
+		return 0, func() {}
+	}
+
+	ip := l.clientIP(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return http.StatusServiceUnavailable, nil
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return http.StatusTooManyRequests, nil
+	}
+	l.total++
+	l.perIP[ip]++
+
+	var once sync.Once
+	return 0, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if l.perIP[ip]--; l.perIP[ip] == 0 {
+				delete(l.perIP, ip)
+			}
+		})
+	}
+}
+
+// Returns the IP the per IP cap counts: the connection's peer, unless the peer is a trusted proxy. Then it is the
+// last X-Forwarded-For hop that is not a trusted proxy itself, since the hops before it are whatever the client sent.
+func (l *connLimiter) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(peerAddr(r))
+	if err != nil {
+		ip = peerAddr(r)
+	}
+	if !l.trusts(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !l.trusts(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (l *connLimiter) trusts(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, network := range l.trusted {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}